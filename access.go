@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// checkDestAccess makes sure files can be created, written, chmodded,
+// renamed and removed at the destination, on a scratch file, so a
+// destination the sync can't write to fails at startup, saying what
+// doesn't work, rather than partway through the initial sync.
+func checkDestAccess() error {
+	dir := probeDir()
+
+	f, err := ioutil.TempFile(dir, ".sync-access")
+	if err != nil {
+		return accessError("create", dir, err)
+	}
+
+	name := f.Name()
+	renamed := filepath.Join(dir, filepath.Base(name)+".renamed")
+
+	defer os.Remove(name)
+	defer os.Remove(renamed)
+
+	_, err = f.WriteString("sync access check\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return accessError("write", dir, err)
+	}
+
+	if err = os.Chmod(name, 0600); err != nil {
+		return accessError("chmod", dir, err)
+	}
+
+	if err = os.Rename(name, renamed); err != nil {
+		return accessError("rename", dir, err)
+	}
+
+	if err = os.Remove(renamed); err != nil {
+		return accessError("remove", dir, err)
+	}
+
+	return nil
+}
+
+func accessError(what, dir string, err error) error {
+	if os.IsPermission(err) {
+		return errors.Errorf("can't %s files in %s, check its permissions and owner: %s", what, dir, err)
+	}
+
+	return errors.Wrapf(err, "can't %s files in %s", what, dir)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+var agentPlist = template.Must(template.New("plist").Funcs(template.FuncMap{
+	"xml": func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>WorkingDirectory</key>
+	<string>{{xml .Dir}}</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardErrorPath</key>
+	<string>{{xml .Log}}</string>
+</dict>
+</plist>
+`))
+
+// installAgent writes a launchd agent running the sync with the flags
+// given, and loads it so it runs now and at every login.
+func installAgent() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrapf(err, "finding executable")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	label := "com.github.evanphx.sync." + *fSvcN
+
+	var buf bytes.Buffer
+
+	err = agentPlist.Execute(&buf, map[string]interface{}{
+		"Label": label,
+		"Args":  append([]string{exe}, os.Args[1:]...),
+		"Dir":   dir,
+		"Log":   filepath.Join(home, "Library", "Logs", label+".log"),
+	})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(home, "Library", "LaunchAgents", label+".plist")
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Unload any agent from before, so the new plist takes effect.
+	runCmd("launchctl", "unload", path)
+
+	if err = ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "writing %s", path)
+	}
+
+	if _, err = runCmd("launchctl", "load", "-w", path); err != nil {
+		return err
+	}
+
+	log.Printf("Installed launchd agent %s, remove it with launchctl unload -w %s and deleting the plist", label, path)
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+import "github.com/pkg/errors"
+
+// installAgent fails, launchd agents are a macOS thing.
+func installAgent() error {
+	return errors.New("install-agent is only supported on macOS")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// atomicSyncDirs performs the initial sync into a staging directory next
+// to the destination and then swaps it with the destination, so consumers
+// never see a partially synced tree. After the swap the staging directory
+// holds the previous tree, which makes the next run incremental, once
+// what's since gone from the source is pruned from it.
+func atomicSyncDirs(w watcher, cancel chan os.Signal, r syncRoots, statusPath string) error {
+	live := r.dest
+	staging := live + ".new"
+
+	err := os.MkdirAll(staging, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "creating staging directory")
+	}
+
+	if *fComp {
+		compressTree(staging)
+	}
+
+	log.Printf("Staging initial sync in %s", staging)
+
+	staged := syncRoots{src: r.src, dest: staging}
+
+	err = syncDirs(w, cancel, staged)
+	if err == nil && !*fOvly {
+		err = pruneIn(staged, ".")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Mark the staged tree ready before it goes live.
+	f, err := os.Create(statusPath)
+	if err == nil {
+		f.Close()
+	}
+
+	if _, err = os.Lstat(live); os.IsNotExist(err) {
+		err = os.Rename(staging, live)
+	} else {
+		err = exchangeDirs(staging, live)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "swapping %s into place", staging)
+	}
+
+	log.Printf("Swapped %s into place, changes from here on are applied in place", live)
+
+	return nil
+}
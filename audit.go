@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A manifest lists the hash of every file synced, in the format of
+// sha256sum and friends, after a header naming the hash. With
+// -manifest-key it ends with an ed25519 signature of everything before it,
+// so a later audit can tell the manifest itself wasn't altered.
+
+const (
+	manifestHeader = "# sync manifest "
+	manifestSig    = "# signature "
+)
+
+// writeManifest writes the -write-manifest of the destination's copies of
+// the source's files.
+func writeManifest(cancel chan os.Signal) error {
+	var (
+		buf bytes.Buffer
+		n   int
+	)
+
+	fmt.Fprintf(&buf, "%s%s\n", manifestHeader, *fHash)
+
+	err := walkSource(cancel, func(path, rel string, fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		// Files put off or failing aren't synced, so aren't listed.
+		// The manifest describes the destination, so lists where -map
+		// put things.
+		rel = destRel(rel)
+
+		sum, err := fileChecksum(filepath.Join(*fDest, rel))
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&buf, "%x  %s\n", sum, filepath.ToSlash(rel))
+		n++
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "writing manifest")
+	}
+
+	if *fMKey != "" {
+		priv, _, err := manifestKey()
+		if err != nil {
+			return err
+		}
+
+		if priv == nil {
+			return errors.New("-manifest-key must be a private key to sign with")
+		}
+
+		fmt.Fprintf(&buf, "%s%s\n", manifestSig, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, buf.Bytes())))
+	}
+
+	tmp := *fWMan + ".sync-tmp"
+
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err == nil {
+		err = os.Rename(tmp, *fWMan)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "writing manifest")
+	}
+
+	log.Printf("Wrote manifest of %d files to %s", n, *fWMan)
+
+	return nil
+}
+
+// runManifestVerify checks -dest against -manifest, checking its signature
+// too with -manifest-key. It fails if anything differs.
+func runManifestVerify() error {
+	if *fMani == "" {
+		return errors.New("verify requires -manifest")
+	}
+
+	data, err := ioutil.ReadFile(*fMani)
+	if err != nil {
+		return errors.Wrapf(err, "reading manifest")
+	}
+
+	body := data
+
+	if i := bytes.LastIndex(data, []byte("\n"+manifestSig)); i >= 0 {
+		body = data[:i+1]
+
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data[i+1+len(manifestSig):])))
+		if err != nil {
+			return errors.Wrapf(err, "decoding manifest signature")
+		}
+
+		if *fMKey == "" {
+			log.Printf("Not checking the manifest's signature, there's no -manifest-key")
+		} else {
+			_, pub, err := manifestKey()
+			if err != nil {
+				return err
+			}
+
+			if !ed25519.Verify(pub, body, sig) {
+				return errors.New("manifest signature doesn't match, it was altered or signed with another key")
+			}
+
+			log.Printf("Manifest signature checks out")
+		}
+	} else if *fMKey != "" {
+		return errors.New("manifest isn't signed")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), manifestHeader) {
+		return errors.New("not a sync manifest")
+	}
+
+	*fHash = strings.TrimPrefix(scanner.Text(), manifestHeader)
+
+	switch *fHash {
+	case "sha256", "blake3", "xxhash64":
+	default:
+		return fmt.Errorf("manifest uses unknown hash %s", *fHash)
+	}
+
+	log.Printf("Verifying %s against %s", *fDest, *fMani)
+
+	var drift int
+
+	listed := make(map[string]bool)
+
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		rel := filepath.FromSlash(fields[1])
+		listed[rel] = true
+
+		sum, err := fileChecksum(filepath.Join(*fDest, rel))
+		switch {
+		case os.IsNotExist(err):
+			log.Printf("Drift: %s missing", rel)
+			drift++
+		case err != nil:
+			return err
+		case hex.EncodeToString(sum) != fields[0]:
+			log.Printf("Drift: %s content differs", rel)
+			drift++
+		}
+	}
+
+	err = streamWalk(*fDest, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(*fDest, path)
+		if err != nil {
+			return err
+		}
+
+		if syncInternal(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if fi.Mode().IsRegular() && !listed[rel] {
+			log.Printf("Drift: %s not in manifest", rel)
+			drift++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if drift > 0 {
+		return fmt.Errorf("%d differences from manifest", drift)
+	}
+
+	log.Printf("Verified, %d files match the manifest", len(listed))
+
+	return nil
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return checksum(f)
+}
+
+// manifestKey reads -manifest-key, a PEM ed25519 key. A private key gives
+// both halves, a public one only the public half.
+func manifestKey() (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(*fMKey)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading -manifest-key")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("-manifest-key isn't PEM")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if priv, ok := key.(ed25519.PrivateKey); ok {
+			return priv, priv.Public().(ed25519.PublicKey), nil
+		}
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if pub, ok := key.(ed25519.PublicKey); ok {
+			return nil, pub, nil
+		}
+	}
+
+	return nil, nil, errors.New("-manifest-key isn't an ed25519 key")
+}
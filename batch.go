@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batch collects the paths touched by events arriving within the debounce
+// window so they can be applied to the destination together.
+
+// chmodWait is how long Chmod events are gathered for without -debounce,
+// so a storm of them, as from chmod -R, syncs each path once.
+const chmodWait = 250 * time.Millisecond
+
+type batch struct {
+	ops map[string]fsnotify.Op
+}
+
+func newBatch() *batch {
+	return &batch{ops: make(map[string]fsnotify.Op)}
+}
+
+func (b *batch) add(rel string, op fsnotify.Op) {
+	b.ops[rel] |= op
+}
+
+// paths returns the touched paths, parents before their children.
+func (b *batch) paths() []string {
+	paths := make([]string, 0, len(b.ops))
+	for rel := range b.ops {
+		paths = append(paths, rel)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// applyMoves renames the destinations of directories moved within the
+// source and drops their events from b. Directories moved out of the
+// tree are removed.
+func applyMoves(ctx context.Context, b *batch, w watcher) {
+	mv := make(moves)
+
+	for rel, op := range b.ops {
+		if op&fsnotify.Rename == fsnotify.Rename && mv.renamed(rel) {
+			delete(b.ops, rel)
+		}
+	}
+
+	if len(mv) == 0 {
+		return
+	}
+
+	for _, rel := range b.paths() {
+		if b.ops[rel]&fsnotify.Create != fsnotify.Create {
+			continue
+		}
+
+		if old, ok := mv.created(rel); ok {
+			moveOrCopy(ctx, old, rel, w)
+			delete(b.ops, rel)
+		}
+	}
+
+	mv.flush(w)
+}
+
+var batchSeq int
+
+// stagePath is where new content for to is written before it's revealed.
+func stagePath(to string) string {
+	return filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".sync-tmp")
+}
+
+// applyBatch brings every path in b in line with the current state of the
+// source. New file content is first staged next to its final location, then
+// all the staged files, removals, links and mode changes are revealed
+// together. A path that fails is left out and retried like a failed event,
+// without holding up the rest. Each applied batch is recorded in the status
+// file, once the readiness gates have let it be written.
+func applyBatch(b *batch, w watcher, statusPath string) (err error) {
+	paths := b.paths()
+
+	ctx, span := tracer.Start(context.Background(), "sync.batch",
+		trace.WithAttributes(attribute.Int("sync.batch.size", len(paths))))
+	defer func() {
+		if err != nil {
+			publishError("", err)
+		}
+
+		endSpan(span, err)
+	}()
+
+	log.Printf("Applying batch of %d changes", len(paths))
+
+	failed := func(rel string, err error) {
+		publishError(rel, err)
+		recordFailure(ctx, rel, err)
+	}
+
+	applyMoves(ctx, b, w)
+
+	paths = b.paths()
+
+	var (
+		staged  []string
+		links   []string
+		chmods  []string
+		removes []string
+	)
+
+	for _, rel := range paths {
+		var (
+			op   = b.ops[rel]
+			from = filepath.Join(*fSrc, rel)
+			to   = destPath(rel)
+		)
+
+		fi, err := os.Lstat(from)
+		if err != nil {
+			if os.IsNotExist(err) {
+				removes = append(removes, rel)
+				continue
+			}
+
+			failed(rel, err)
+			continue
+		}
+
+		switch {
+		case fi.IsDir():
+			// Directories are created up front so staged files have
+			// somewhere to go.
+			if err = stageDir(rel, fi, w); err != nil {
+				failed(rel, err)
+			}
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			links = append(links, rel)
+		case fi.Mode().IsRegular():
+			if op&(fsnotify.Create|fsnotify.Write) != 0 {
+				if err = copyFileTo(ctx, rel, stagePath(to), true); err != nil {
+					os.Remove(stagePath(to))
+					failed(rel, err)
+					continue
+				}
+
+				staged = append(staged, rel)
+			} else if op&fsnotify.Chmod == fsnotify.Chmod {
+				chmods = append(chmods, rel)
+			}
+		}
+	}
+
+	for _, rel := range removes {
+		if err := removeEntry(rel, w); err != nil {
+			failed(rel, err)
+		}
+	}
+
+	for _, rel := range staged {
+		to := destPath(rel)
+
+		if tfi, err := os.Lstat(to); err == nil && tfi.IsDir() {
+			os.RemoveAll(to)
+		}
+
+		err := os.Rename(stagePath(to), to)
+		if err != nil {
+			// copyFileTo skips files whose destination directory
+			// has vanished.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			os.Remove(stagePath(to))
+			failed(rel, errors.Wrapf(err, "revealing %s", rel))
+		}
+	}
+
+	for _, rel := range links {
+		if err := setupLink(destPath(rel), filepath.Join(*fSrc, rel)); err != nil {
+			failed(rel, err)
+		}
+	}
+
+	for _, rel := range chmods {
+		if err := syncMetadata(ctx, rel); err != nil {
+			failed(rel, err)
+		}
+	}
+
+	batchSeq++
+
+	if !readiness.ready {
+		return nil
+	}
+
+	return writeStatus(statusPath, fmt.Sprintf("batch %d %s\n", batchSeq, time.Now().Format(time.RFC3339)))
+}
+
+// stageDir makes sure the directory at rel exists at the destination and
+// is watched.
+func stageDir(rel string, fi os.FileInfo, w watcher) error {
+	to := destPath(rel)
+
+	tfi, err := os.Lstat(to)
+	if err == nil && tfi.IsDir() {
+		return os.Chmod(to, fi.Mode())
+	}
+
+	if err == nil {
+		if err = os.Remove(to); err != nil {
+			return errors.Wrapf(err, "removing errant non-dir")
+		}
+	}
+
+	log.Printf("Created directory %s", rel)
+
+	err = os.Mkdir(to, fi.Mode())
+	if err != nil {
+		return errors.Wrapf(err, "making a directory")
+	}
+
+	watchDir(w, filepath.Join(*fSrc, rel), fi)
+
+	return nil
+}
+
+// writeStatus atomically replaces the content of the status file.
+func writeStatus(statusPath, content string) error {
+	tmp := stagePath(statusPath)
+
+	err := ioutil.WriteFile(tmp, []byte(content), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "writing status")
+	}
+
+	return os.Rename(tmp, statusPath)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// execDebounce is the -debounce used for -exec when none is given, so a
+// burst of changes runs the command once.
+const execDebounce = 300 * time.Millisecond
+
+// batchExec runs -exec after batches land. Only one run happens at a time;
+// batches landing during a run are run for together once it's done.
+var batchExec struct {
+	sync.Mutex
+	running bool
+	paths   []string
+}
+
+// runExec runs -exec for a batch of changed paths, in the background.
+func runExec(paths []string) {
+	if *fExec == "" {
+		return
+	}
+
+	batchExec.Lock()
+	defer batchExec.Unlock()
+
+	batchExec.paths = append(batchExec.paths, paths...)
+
+	if batchExec.running {
+		return
+	}
+
+	batchExec.running = true
+
+	go func() {
+		for {
+			batchExec.Lock()
+			paths := batchExec.paths
+			batchExec.paths = nil
+
+			if len(paths) == 0 {
+				batchExec.running = false
+				batchExec.Unlock()
+				return
+			}
+
+			batchExec.Unlock()
+
+			if err := execOnce(paths); err != nil {
+				log.Printf("Exec failed: %s", err)
+				publishError("", err)
+			}
+		}
+	}()
+}
+
+// execOnce runs -exec in the destination with the changed paths on its
+// stdin, one per line, logging what it prints.
+func execOnce(paths []string) error {
+	cmd := shellCommand(context.Background(), *fExec)
+	cmd.Dir = *fDest
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\n") + "\n")
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = cmd.Stdout
+
+	log.Printf("Exec %s (%d changes)", *fExec, len(paths))
+
+	start := time.Now()
+
+	if err = cmd.Start(); err != nil {
+		return errors.Wrapf(err, "starting %s", *fExec)
+	}
+
+	logLines(out)
+
+	if err = cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "running %s", *fExec)
+	}
+
+	log.Printf("Exec done (%s elapsed)", time.Since(start))
+
+	return nil
+}
+
+func logLines(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("exec: %s", scanner.Text())
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand runs line with cmd.exe, killing it if ctx is done.
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", line)
+}
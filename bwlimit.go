@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// byteRate is a flag for bytes a second, taking K, M and G suffixes.
+type byteRate int64
+
+func (b *byteRate) String() string {
+	return strconv.FormatInt(int64(b.get()), 10)
+}
+
+// get returns the rate, which a config reload can change while copies
+// are running.
+func (b *byteRate) get() byteRate {
+	return byteRate(atomic.LoadInt64((*int64)(b)))
+}
+
+func (b *byteRate) Set(value string) error {
+	mult := int64(1)
+
+	switch s := strings.ToUpper(strings.TrimSpace(value)); {
+	case strings.HasSuffix(s, "K"):
+		mult, value = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult, value = 1<<20, s[:len(s)-1]
+	case strings.HasSuffix(s, "G"):
+		mult, value = 1<<30, s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return errors.Errorf("expected bytes a second like 512K or 10M, not %q", value)
+	}
+
+	atomic.StoreInt64((*int64)(b), n*mult)
+
+	return nil
+}
+
+var (
+	readLimit, writeLimit byteRate
+
+	// readPace and writePace are shared by every copy, so the limits hold
+	// for all of them together.
+	readPace, writePace pacer
+)
+
+func init() {
+	flag.Var(&writeLimit, "bwlimit", "limit writes to -dest to this many bytes a second, eg 10M (0 is unlimited)")
+	flag.Var(&readLimit, "read-bwlimit", "limit reads from -src to this many bytes a second, separately from -bwlimit")
+}
+
+// paceChunk is the most read or written between waits, so a big buffer
+// doesn't get through in one burst.
+const paceChunk = 64 << 10
+
+// pacer spreads transfers out to keep them under a rate.
+type pacer struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks for as long as n bytes take at rate.
+func (p *pacer) wait(n int, rate byteRate) {
+	if rate <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+
+	p.next = p.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	until := p.next
+
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(until))
+}
+
+// limitRead applies -read-bwlimit to r, a reader of the source.
+func limitRead(r io.Reader) io.Reader {
+	if readLimit.get() <= 0 {
+		return r
+	}
+
+	return pacedReader{r}
+}
+
+// limitWrite applies -bwlimit to w, a writer to the destination.
+func limitWrite(w io.Writer) io.Writer {
+	if writeLimit.get() <= 0 {
+		return w
+	}
+
+	return pacedWriter{w}
+}
+
+type pacedReader struct {
+	r io.Reader
+}
+
+func (p pacedReader) Read(b []byte) (int, error) {
+	if len(b) > paceChunk {
+		b = b[:paceChunk]
+	}
+
+	n, err := p.r.Read(b)
+	if n > 0 {
+		readPace.wait(n, readLimit.get())
+	}
+
+	return n, err
+}
+
+type pacedWriter struct {
+	w io.Writer
+}
+
+func (p pacedWriter) Write(b []byte) (int, error) {
+	var written int
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > paceChunk {
+			chunk = chunk[:paceChunk]
+		}
+
+		writePace.wait(len(chunk), writeLimit.get())
+
+		n, err := p.w.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// In content-addressed mode, file contents are stored once in the blob
+// directory under the hash of their content and mode, and the files in
+// the destination are hardlinks to those blobs. Because the links share
+// an inode, a blob is never modified once written; changes always store
+// a new blob and swap the link.
+
+func blobDir() string {
+	return liveRoots().blobs()
+}
+
+// blobs is blobDir within r.
+func (r syncRoots) blobs() string {
+	if *fBlob != "" {
+		return *fBlob
+	}
+
+	return filepath.Join(r.dest, ".sync-blobs")
+}
+
+// storeBlob copies r into the blob store dir, returning the path of the
+// blob holding the content and the number of bytes read.
+func storeBlob(dir string, r io.Reader, mode os.FileMode) (string, int64, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "creating blob directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".incoming-")
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "creating blob")
+	}
+
+	h := newHash()
+
+	n, err := io.Copy(io.MultiWriter(limitWrite(tmp), h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", n, errors.Wrapf(err, "writing blob")
+	}
+
+	// The mode is part of the name because every link to a blob shares
+	// its permissions.
+	sum := hex.EncodeToString(h.Sum(nil))
+	blob := filepath.Join(dir, sum[:2], fmt.Sprintf("%s.%o", sum, mode.Perm()))
+
+	if _, err = os.Lstat(blob); err == nil {
+		os.Remove(tmp.Name())
+		return blob, n, nil
+	}
+
+	if err = os.MkdirAll(filepath.Dir(blob), 0755); err == nil {
+		if err = os.Chmod(tmp.Name(), mode.Perm()); err == nil {
+			err = os.Rename(tmp.Name(), blob)
+		}
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", n, errors.Wrapf(err, "storing blob")
+	}
+
+	return blob, n, nil
+}
+
+// linkBlob atomically replaces to with a hardlink to blob.
+func linkBlob(blob, to string) error {
+	tmp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".sync-tmp")
+
+	os.Remove(tmp)
+
+	err := os.Link(blob, tmp)
+	if err != nil {
+		return errors.Wrapf(err, "linking blob")
+	}
+
+	if fi, err := os.Lstat(to); err == nil && fi.IsDir() {
+		os.RemoveAll(to)
+	}
+
+	err = os.Rename(tmp, to)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "renaming blob link into place")
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Building with -tags chaos adds -chaos, which injects copy failures, slow
+// writes and dropped events to exercise the retry and rescan paths. With
+// -chaos-seed the same failures come up on every run.
+
+// chaosSpec is the -chaos flag, like fail=0.1,slow=5ms,drop=0.05.
+type chaosSpec struct {
+	fail float64
+	slow time.Duration
+	drop float64
+}
+
+func (c *chaosSpec) String() string {
+	return fmt.Sprintf("fail=%g,slow=%s,drop=%g", c.fail, c.slow, c.drop)
+}
+
+func (c *chaosSpec) Set(value string) error {
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("expected KEY=VALUE, not %q", kv)
+		}
+
+		var err error
+
+		switch parts[0] {
+		case "fail":
+			c.fail, err = strconv.ParseFloat(parts[1], 64)
+		case "slow":
+			c.slow, err = time.ParseDuration(parts[1])
+		case "drop":
+			c.drop, err = strconv.ParseFloat(parts[1], 64)
+		default:
+			return errors.Errorf("unknown -chaos setting: %s", parts[0])
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "parsing -chaos %s", parts[0])
+		}
+	}
+
+	return nil
+}
+
+var (
+	chaos     chaosSpec
+	chaosSeed int64
+
+	chaosRand = struct {
+		sync.Mutex
+		*rand.Rand
+	}{}
+)
+
+func init() {
+	flag.Var(&chaos, "chaos", "inject failures: fail=RATE of copies, slow=DELAY per write, drop=RATE of events")
+	flag.Int64Var(&chaosSeed, "chaos-seed", 1, "seed for -chaos, so a run's failures can be repeated")
+}
+
+// chaosOn reports if -chaos injects anything.
+func chaosOn() bool {
+	return chaos.fail > 0 || chaos.slow > 0 || chaos.drop > 0
+}
+
+// chaosHit reports if an injection with the given rate should happen.
+func chaosHit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+
+	if chaosRand.Rand == nil {
+		chaosRand.Rand = rand.New(rand.NewSource(chaosSeed))
+	}
+
+	return chaosRand.Float64() < rate
+}
+
+// chaosCopy returns an injected failure for copying rel, or nil.
+func chaosCopy(rel string) error {
+	if !chaosHit(chaos.fail) {
+		return nil
+	}
+
+	log.Printf("chaos: failing copy of %s", rel)
+
+	return errors.Errorf("chaos: injected failure copying %s", rel)
+}
+
+// chaosWriter slows every write to w down by -chaos slow.
+func chaosWriter(w io.Writer) io.Writer {
+	if chaos.slow <= 0 {
+		return w
+	}
+
+	return slowWriter{w}
+}
+
+type slowWriter struct {
+	io.Writer
+}
+
+func (s slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(chaos.slow)
+	return s.Writer.Write(b)
+}
+
+// chaosDrop reports if ev should be dropped, as if the watcher missed it.
+func chaosDrop(ev fsnotify.Event) bool {
+	if !chaosHit(chaos.drop) {
+		return false
+	}
+
+	log.Printf("chaos: dropping event %s", ev)
+
+	return true
+}
@@ -0,0 +1,20 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+import (
+	"io"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Without the chaos build tag there's nothing injected.
+
+func chaosOn() bool { return false }
+
+func chaosCopy(string) error { return nil }
+
+func chaosWriter(w io.Writer) io.Writer { return w }
+
+func chaosDrop(fsnotify.Event) bool { return false }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/codeskyblue/dockerignore"
+	"github.com/pkg/errors"
+)
+
+// runCheckIgnore prints which of the paths given as arguments the sync
+// ignores, using the same checks it does. Paths are relative to -src, or
+// absolute inside it. With -explain, every path is printed after what
+// ignores it, or "::" if nothing does.
+func runCheckIgnore() error {
+	if flag.NArg() == 0 {
+		return errors.New("check-ignore requires paths to check")
+	}
+
+	for _, arg := range flag.Args() {
+		rel, err := srcRel(arg)
+		if err != nil {
+			return err
+		}
+
+		why := ignoreReason(rel)
+
+		switch {
+		case *fExpl && why == "":
+			fmt.Printf("::\t%s\n", arg)
+		case *fExpl:
+			fmt.Printf("%s\t%s\n", why, arg)
+		case why != "":
+			fmt.Println(arg)
+		}
+	}
+
+	return nil
+}
+
+// srcRel returns path relative to -src.
+func srcRel(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+
+	src, err := filepath.Abs(*fSrc)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(src, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", errors.Errorf("%s isn't inside %s", path, *fSrc)
+	}
+
+	return rel, nil
+}
+
+// ignoreReason explains why ignored or ignoredDir would exclude rel, or
+// returns "" if they wouldn't.
+func ignoreReason(rel string) string {
+	if p, file := dockerMatch(rel); p != "" {
+		return fmt.Sprintf("%s: %s", file, p)
+	}
+
+	if p, ok := stMatch(rel); ok && !p.include {
+		return p.source
+	}
+
+	if p, ok := gitMatch(rel); ok && !p.include {
+		return p.source
+	}
+
+	if isHidden(rel) {
+		return "-skip-hidden"
+	}
+
+	if isPauseFile(rel) {
+		return "-pause-file"
+	}
+
+	if why := pathTooLong(rel); *fPLim == "skip" && why != "" {
+		return "-path-limits: " + why
+	}
+
+	if *fSecr == "refuse" && isSecret(rel) {
+		return "-secrets refuse"
+	}
+
+	fi, err := os.Stat(filepath.Join(*fSrc, rel))
+	if err == nil && fi.IsDir() && ignoredDir(rel) {
+		p, file := dockerMatch(filepath.Join(rel, "**"))
+		return fmt.Sprintf("%s: %s (everything in it)", file, p)
+	}
+
+	return ""
+}
+
+// dockerMatch returns the docker pattern excluding rel and the file it's
+// from, if any. The last pattern matching a path decides, so that's the
+// one returned.
+func dockerMatch(rel string) (string, string) {
+	if match, err := ignore.Matches(rel, ignorePatterns); err != nil || !match {
+		return "", ""
+	}
+
+	for i := len(ignorePatterns) - 1; i >= 0; i-- {
+		p := strings.TrimPrefix(ignorePatterns[i], "!")
+
+		if match, err := ignore.Matches(rel, []string{p}); err == nil && match {
+			return ignorePatterns[i], ignoreSources[i]
+		}
+	}
+
+	return "", ""
+}
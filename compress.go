@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// With -compress-dest the destination's filesystem is asked to compress
+// what's synced, by marking its directories compressed, which new files
+// and directories in them inherit. The files stay as they are to anything
+// reading them, so nothing else about the sync changes. Only filesystems
+// with per-file compression, like btrfs, support it.
+
+// compressTree marks root and every directory below it compressed. If the
+// filesystem can't, -compress-dest is turned off, saying so.
+func compressTree(root string) {
+	if err := checkCompression(root); err != nil {
+		log.Printf("Turning off -compress-dest: %s", err)
+		*fComp = false
+
+		return
+	}
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+
+		return compressPath(path)
+	})
+
+	if err != nil {
+		log.Printf("Turning off -compress-dest, the destination can't compress: %s", err)
+		*fComp = false
+	}
+}
+
+// compressFile marks f compressed, for a copy overwriting a file from
+// before its directory was marked.
+func compressFile(f *os.File) {
+	if !*fComp {
+		return
+	}
+
+	if err := setCompressed(f); err != nil {
+		log.Printf("Unable to compress %s: %s", f.Name(), err)
+	}
+}
+
+// compressPath marks the file or directory at path compressed.
+func compressPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return setCompressed(f)
+}
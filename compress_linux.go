@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fsComprFl is FS_COMPR_FL, the inode flag asking for compression.
+const fsComprFl = 0x00000004
+
+// checkCompression returns why the filesystem at path won't compress
+// files, if it won't. Others, like ext4, accept the flag but ignore it.
+func checkCompression(path string) error {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+
+	switch uint32(st.Type) {
+	case unix.BTRFS_SUPER_MAGIC, unix.F2FS_SUPER_MAGIC:
+		return nil
+	}
+
+	return errors.Errorf("the filesystem of %s doesn't compress files, only btrfs and f2fs do", path)
+}
+
+// setCompressed sets the compression flag on f.
+func setCompressed(f *os.File) error {
+	fd := int(f.Fd())
+
+	flags, err := unix.IoctlGetInt(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+
+	if flags&fsComprFl != 0 {
+		return nil
+	}
+
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, flags|fsComprFl)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// checkCompression fails, compression attributes are only supported on
+// Linux.
+func checkCompression(string) error {
+	return errors.New("compression attributes are only supported on Linux")
+}
+
+func setCompressed(*os.File) error {
+	return errors.New("compression attributes are only supported on Linux")
+}
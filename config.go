@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// The config file holds flag settings, one per line as "name value" or
+// "name = value". Blank lines and lines starting with # are skipped. Flags
+// given on the command line take precedence over the config file.
+//
+// A line "[NAME]" starts a profile, whose settings only apply with
+// -profile NAME, over those before the first profile. In a profile,
+// "include OTHER" applies OTHER's settings as if they were at that line,
+// so an all profile can be made of the others, and "pair SRC DEST [ARGS]"
+// adds a pair for the daemon to start. Pairs before the first profile are
+// started whatever the profile. Every pair is given the settings in
+// effect, other than the daemon's own, ahead of its ARGS. A setting on
+// several lines is set by each in turn, so repeatable flags get every
+// value and others the last.
+
+// reloadable are the flags that are safe to change while running. A new
+// -workers takes effect from the next walk, and new rate limits from the
+// next copy.
+var reloadable = map[string]bool{
+	"bwlimit":       true,
+	"debounce":      true,
+	"defer-open":    true,
+	"ignore":        true,
+	"ignore-chmod":  true,
+	"modify-window": true,
+	"read-bwlimit":  true,
+	"retries":       true,
+	"settle-min":    true,
+	"skip-hidden":   true,
+	"workers":       true,
+}
+
+var (
+	// cmdline are the flags set on the command line.
+	cmdline = make(map[string]bool)
+
+	// configValues are the settings last read from the config file, each
+	// with its values in order.
+	configValues = make(map[string][]string)
+
+	// configPairs are the pairs of the config file for the daemon.
+	configPairs []configPair
+)
+
+// configPair is a pair line of the config file.
+type configPair struct {
+	src, dest string
+	args      []string
+}
+
+// configLine is a setting, include or pair line of a profile.
+type configLine struct {
+	n           int
+	name, value string
+}
+
+func readConfig(path string) (map[string][]string, []configPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "opening config")
+	}
+
+	defer f.Close()
+
+	var (
+		profiles = map[string][]configLine{"": nil}
+		profile  string
+	)
+
+	s := bufio.NewScanner(f)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			profile = strings.TrimSpace(line[1 : len(line)-1])
+
+			if _, ok := profiles[profile]; ok || profile == "" {
+				return nil, nil, errors.Errorf("%s:%d: duplicate profile %q", path, n, profile)
+			}
+
+			profiles[profile] = nil
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i:])
+			value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		}
+
+		switch {
+		case name == "include" && profile == "":
+			return nil, nil, errors.Errorf("%s:%d: include outside a profile", path, n)
+		case name == "include", name == "pair":
+		case flag.Lookup(name) == nil || name == "config" || name == "profile":
+			return nil, nil, errors.Errorf("%s:%d: unknown setting %s", path, n, name)
+		}
+
+		profiles[profile] = append(profiles[profile], configLine{n: n, name: name, value: value})
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "reading config")
+	}
+
+	if _, ok := profiles[*fProf]; !ok {
+		return nil, nil, errors.Errorf("%s has no profile %q", path, *fProf)
+	}
+
+	var (
+		values = make(map[string][]string)
+		pairs  []configPair
+		using  = make(map[string]bool)
+		apply  func(profile string) error
+	)
+
+	apply = func(profile string) error {
+		if using[profile] {
+			return errors.Errorf("%s: profile %q is included in a loop", path, profile)
+		}
+
+		using[profile] = true
+		defer delete(using, profile)
+
+		for _, l := range profiles[profile] {
+			switch l.name {
+			case "include":
+				if _, ok := profiles[l.value]; !ok || l.value == "" {
+					return errors.Errorf("%s:%d: no profile %q to include", path, l.n, l.value)
+				}
+
+				if err := apply(l.value); err != nil {
+					return err
+				}
+			case "pair":
+				fields := strings.Fields(l.value)
+				if len(fields) < 2 {
+					return errors.Errorf("%s:%d: pair needs a source and destination", path, l.n)
+				}
+
+				pairs = append(pairs, configPair{src: fields[0], dest: fields[1], args: fields[2:]})
+			default:
+				values[l.name] = append(values[l.name], l.value)
+			}
+		}
+
+		return nil
+	}
+
+	if err = apply(""); err != nil {
+		return nil, nil, err
+	}
+
+	if *fProf != "" {
+		if err = apply(*fProf); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return values, pairs, nil
+}
+
+// loadConfig applies the config file to the flags not set on the command
+// line. It must be called after flag.Parse.
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
+
+	if *fConf == "" {
+		if *fProf != "" {
+			return errors.New("-profile requires -config")
+		}
+
+		return nil
+	}
+
+	values, pairs, err := readConfig(*fConf)
+	if err != nil {
+		return err
+	}
+
+	for name, list := range values {
+		if cmdline[name] {
+			continue
+		}
+
+		for _, value := range list {
+			if err = flag.Set(name, value); err != nil {
+				return errors.Wrapf(err, "setting %s from config", name)
+			}
+		}
+	}
+
+	configValues = values
+	configPairs = pairs
+
+	return nil
+}
+
+// watchConfig returns a watcher for the config file's directory, since
+// editors often replace the file rather than write to it.
+func watchConfig() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = w.Add(filepath.Dir(*fConf)); err != nil {
+		w.Close()
+		return nil, errors.Wrapf(err, "watching config")
+	}
+
+	return w, nil
+}
+
+// isConfigEvent reports if ev is for the config file.
+func isConfigEvent(ev fsnotify.Event) bool {
+	return filepath.Clean(ev.Name) == filepath.Clean(*fConf) &&
+		ev.Op&(fsnotify.Write|fsnotify.Create) != 0
+}
+
+// reloadConfig applies the changes made to the config file since it was
+// last read. Settings that can't change at runtime are left alone, as are
+// pairs, which the daemon only starts once.
+func reloadConfig() {
+	values, _, err := readConfig(*fConf)
+	if err != nil {
+		log.Printf("Not reloading config: %s", err)
+		return
+	}
+
+	changed := make(map[string]bool)
+
+	for name, list := range values {
+		if old, ok := configValues[name]; !ok || !sameValues(old, list) {
+			changed[name] = true
+		}
+	}
+
+	for name := range configValues {
+		if _, ok := values[name]; !ok {
+			changed[name] = true
+		}
+	}
+
+	for name := range changed {
+		list, ok := values[name]
+
+		switch {
+		case cmdline[name]:
+			log.Printf("Ignoring config change to %s, it's set on the command line", name)
+			continue
+		case !reloadable[name]:
+			log.Printf("Ignoring config change to %s, it requires a restart", name)
+			continue
+		}
+
+		if !ok {
+			list = []string{flag.Lookup(name).DefValue}
+		}
+
+		// The list of files is replaced rather than added to.
+		if name == "ignore" {
+			ignoreFiles = nil
+		}
+
+		for _, value := range list {
+			if err = flag.Set(name, value); err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			log.Printf("Ignoring config change to %s: %s", name, err)
+			continue
+		}
+
+		log.Printf("Config reloaded: %s = %s", name, strings.Join(list, ", "))
+
+		if name == "ignore" {
+			if err := loadIgnore(); err != nil {
+				log.Printf("Error reloading ignore patterns: %s", err)
+			}
+
+			dirPrints = nil
+		}
+	}
+
+	configValues = values
+}
+
+// sameValues reports if a and b hold the same values in the same order.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+)
+
+const (
+	// copyAheadMin is the size from which files are copied with reads
+	// running ahead of writes.
+	copyAheadMin = 64 << 20
+
+	// copyAheadBuf is the size of each of the two buffers.
+	copyAheadBuf = 4 << 20
+)
+
+// copyData copies r to w, using copyAhead when size is large enough for it
+// to pay off.
+func copyData(w io.Writer, r io.Reader, size int64) (int64, error) {
+	if size < copyAheadMin {
+		return io.Copy(w, r)
+	}
+
+	return copyAhead(w, r)
+}
+
+type chunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// copyAhead copies r to w with two buffers, reading into one while the
+// other is written, so a read from one device overlaps a write to another
+// rather than waiting for it.
+func copyAhead(w io.Writer, r io.Reader) (int64, error) {
+	var (
+		free   = make(chan []byte, 2)
+		filled = make(chan chunk, 2)
+		done   = make(chan struct{})
+	)
+
+	free <- make([]byte, copyAheadBuf)
+	free <- make([]byte, copyAheadBuf)
+
+	defer close(done)
+
+	go func() {
+		for {
+			var buf []byte
+
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+
+			n, err := io.ReadFull(r, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+
+			filled <- chunk{buf: buf, n: n, err: err}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var written int64
+
+	for c := range filled {
+		if c.n > 0 {
+			n, err := w.Write(c.buf[:c.n])
+			written += int64(n)
+
+			if err != nil {
+				return written, err
+			}
+		}
+
+		if c.err == io.EOF {
+			return written, nil
+		}
+
+		if c.err != nil {
+			return written, c.err
+		}
+
+		free <- c.buf
+	}
+
+	return written, nil
+}
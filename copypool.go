@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var copyLimits limitList
+
+func init() {
+	flag.Var(&copyLimits, "workers-for", "PATTERN=N to copy at most N files at once under paths matching PATTERN, eg db=1 to copy db/ in order (repeatable)")
+}
+
+// limitList is a flag holding PATTERN=N copy limits, given more than once
+// or separated by commas.
+type limitList []copyLimit
+
+type copyLimit struct {
+	glob string
+	n    int
+}
+
+func (l *limitList) String() string {
+	var parts []string
+	for _, cl := range *l {
+		parts = append(parts, fmt.Sprintf("%s=%d", cl.glob, cl.n))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (l *limitList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		eq := strings.LastIndexByte(part, '=')
+		if eq < 0 {
+			return fmt.Errorf("expected PATTERN=N: %s", part)
+		}
+
+		glob := strings.TrimSuffix(part[:eq], "/")
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return err
+		}
+
+		n, err := strconv.Atoi(part[eq+1:])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid worker count in %s", part)
+		}
+
+		*l = append(*l, copyLimit{glob: glob, n: n})
+	}
+
+	return nil
+}
+
+// lane returns the index of the first limit matching rel or one of the
+// directories it's in, or -1 if none does.
+func (l limitList) lane(rel string) int {
+	for i, cl := range l {
+		for p := rel; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			if matchGlob(cl.glob, p) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// copyPool copies the files of a tree walk concurrently, -workers at a
+// time, and each -workers-for subtree with its own workers. Jobs in a lane
+// are started in the order given, so a lane of 1 copies in walk order.
+type copyPool struct {
+	roots syncRoots
+	lanes []chan copyJob
+	onErr func(rel string, err error) error
+	wg    sync.WaitGroup
+
+	mu   sync.Mutex
+	err  error
+	quit bool
+}
+
+type copyJob struct {
+	ctx context.Context
+	rel string
+}
+
+// newCopyPool returns a pool copying between r, passing failed copies to
+// onErr, or nil when files are to be copied one at a time by the walk
+// itself.
+func newCopyPool(r syncRoots, onErr func(rel string, err error) error) *copyPool {
+	if *fWork <= 1 && len(copyLimits) == 0 {
+		return nil
+	}
+
+	p := &copyPool{roots: r, onErr: onErr}
+
+	counts := make([]int, 0, len(copyLimits)+1)
+	for _, cl := range copyLimits {
+		counts = append(counts, cl.n)
+	}
+
+	counts = append(counts, *fWork)
+
+	for _, n := range counts {
+		if n < 1 {
+			n = 1
+		}
+
+		lane := make(chan copyJob, 64)
+		p.lanes = append(p.lanes, lane)
+
+		for i := 0; i < n; i++ {
+			p.wg.Add(1)
+			go p.work(lane)
+		}
+	}
+
+	return p
+}
+
+func (p *copyPool) work(lane chan copyJob) {
+	defer p.wg.Done()
+
+	for job := range lane {
+		p.mu.Lock()
+		quit := p.quit
+		p.mu.Unlock()
+
+		if quit {
+			continue
+		}
+
+		err := copyFileFrom(job.ctx, p.roots, job.rel, p.roots.to(job.rel), false)
+		if err == nil {
+			continue
+		}
+
+		err = p.onErr(job.rel, errors.Wrapf(err, "copying file"))
+		if err == nil {
+			continue
+		}
+
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = err
+			p.quit = true
+		}
+		p.mu.Unlock()
+	}
+}
+
+// copy queues rel to be copied, returning the error that stopped the pool
+// if a copy failed for good.
+func (p *copyPool) copy(ctx context.Context, rel string) error {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	lane := copyLimits.lane(rel)
+	if lane < 0 {
+		lane = len(p.lanes) - 1
+	}
+
+	p.lanes[lane] <- copyJob{ctx: ctx, rel: rel}
+
+	return nil
+}
+
+// wait waits for the queued copies to be done, or with abandon for those
+// started to finish, and returns the error that stopped the pool.
+func (p *copyPool) wait(abandon bool) error {
+	if abandon {
+		p.mu.Lock()
+		p.quit = true
+		p.mu.Unlock()
+	}
+
+	for _, lane := range p.lanes {
+		close(lane)
+	}
+
+	p.wg.Wait()
+
+	return p.err
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The daemon command serves an HTTP API for adding and removing sync
+// pairs at runtime. Each pair runs as a child sync process, so pairs are
+// isolated from each other and from the daemon, and is restarted when it
+// exits as its restart policy says.
+
+const (
+	// maxRestartBackoff caps the delay between restarts of a failing pair.
+	maxRestartBackoff = 5 * time.Minute
+
+	// restartReset is how long a pair has to run before a failure counts
+	// as the first in a row again.
+	restartReset = time.Minute
+)
+
+// pair is a sync pair run by the daemon.
+type pair struct {
+	ID      string    `json:"id"`
+	Src     string    `json:"src"`
+	Dest    string    `json:"dest"`
+	Args    []string  `json:"args,omitempty"`
+	Restart string    `json:"restart"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Exited  string    `json:"exited,omitempty"`
+
+	// Health is running, restarting, failed or stopped.
+	Health   string `json:"health"`
+	Restarts int    `json:"restarts"`
+
+	cmd      *exec.Cmd
+	control  io.WriteCloser
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+// pairArgs are the flags a pair added through the API can be given. Ones
+// that run commands, read or write files other than the pair's, or put
+// the daemon's environment in the destination are left to its own config.
+var pairArgs = map[string]bool{
+	"allow-secret": true, "atomic-dest": true, "bwlimit": true,
+	"compress-dest": true, "debounce": true, "defer-open": true,
+	"hash": true, "hidden-ok": true, "ignore-chmod": true,
+	"ignore-format": true, "log-ops": true, "long-paths": true,
+	"map": true, "modify-window": true, "mtime-granularity": true,
+	"overlay": true, "path-limits": true, "priority": true,
+	"probe-dest": true, "queue": true, "read-bwlimit": true,
+	"ready-no-retries": true, "rescan": true, "rescan-changed": true,
+	"retries": true, "secret": true, "secrets": true, "skip-hidden": true,
+	"strategy": true, "sync-empty": true, "tar": true,
+	"verify-on-exit": true, "verify-writes": true, "watch-shards": true,
+	"watcher": true, "workers": true, "workers-for": true,
+}
+
+// daemonOnly are the config settings for the daemon itself, which aren't
+// passed on to its pairs.
+var daemonOnly = map[string]bool{
+	"src": true, "dest": true, "api-addr": true, "api-token": true,
+	"restart": true, "restart-backoff": true, "control-stdin": true,
+	"tls-cert": true, "tls-key": true, "tls-client-ca": true,
+	"debug-addr": true, "grpc-addr": true, "log-output": true,
+	"service-name": true,
+}
+
+// apiToken is the token read from -api-token.
+var apiToken string
+
+// readAPIToken reads the -api-token file, if it's set.
+func readAPIToken() error {
+	if *fATok == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*fATok)
+	if err != nil {
+		return errors.Wrapf(err, "reading -api-token")
+	}
+
+	if apiToken = strings.TrimSpace(string(data)); apiToken == "" {
+		return errors.Errorf("-api-token %s is empty", *fATok)
+	}
+
+	return nil
+}
+
+var pairs = struct {
+	sync.Mutex
+	byID map[string]*pair
+	next int
+}{byID: make(map[string]*pair)}
+
+// runDaemon serves the pair API on -api-addr until interrupted, then
+// stops every pair.
+func runDaemon() error {
+	if *fAPI == "" {
+		return errors.New("daemon requires -api-addr")
+	}
+
+	if !restartPolicy(*fRstr) {
+		return errors.Errorf("unknown -restart policy: %s", *fRstr)
+	}
+
+	cfg, err := serverTLS()
+	if err != nil {
+		return err
+	}
+
+	if err = readAPIToken(); err != nil {
+		return err
+	}
+
+	if apiToken == "" && *fCAs == "" {
+		return errors.New("daemon requires -api-token or -tls-client-ca")
+	}
+
+	for _, cp := range configPairs {
+		if _, err = startPair(cp.src, cp.dest, cp.args, *fRstr); err != nil {
+			log.Printf("Unable to start pair %s -> %s from config: %s", cp.src, cp.dest, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pairs", servePairs)
+	mux.HandleFunc("/pairs/", servePair)
+
+	srv := &http.Server{Addr: *fAPI, Handler: mux, TLSConfig: cfg}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		log.Printf("Serving pair API on %s", *fAPI)
+
+		if cfg != nil {
+			errs <- srv.ListenAndServeTLS("", "")
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	cancel := make(chan os.Signal, 1)
+	notifyInterrupt(cancel)
+
+	select {
+	case <-cancel:
+	case err = <-errs:
+		err = errors.Wrapf(err, "serving pair API")
+	}
+
+	pairs.Lock()
+	running := make([]*pair, 0, len(pairs.byID))
+	for _, p := range pairs.byID {
+		running = append(running, p)
+	}
+	pairs.Unlock()
+
+	for _, p := range running {
+		p.stop()
+	}
+
+	return err
+}
+
+// servePairs lists the pairs on GET and adds one on POST, from a JSON
+// body with src, dest and optionally extra args for the sync and a restart
+// policy overriding -restart.
+func servePairs(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		pairs.Lock()
+		list := make([]pair, 0, len(pairs.byID))
+		for _, p := range pairs.byID {
+			list = append(list, *p)
+		}
+		pairs.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var req struct {
+			Src     string   `json:"src"`
+			Dest    string   `json:"dest"`
+			Args    []string `json:"args"`
+			Restart string   `json:"restart"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Src == "" || req.Dest == "" {
+			http.Error(w, "expected a JSON body with src and dest", http.StatusBadRequest)
+			return
+		}
+
+		if err := checkPairArgs(req.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Restart == "" {
+			req.Restart = *fRstr
+		}
+
+		if !restartPolicy(req.Restart) {
+			http.Error(w, "restart must be never, on-failure or always", http.StatusBadRequest)
+			return
+		}
+
+		p, err := startPair(req.Src, req.Dest, req.Args, req.Restart)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pairs.Lock()
+		created := *p
+		pairs.Unlock()
+
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// servePair handles DELETE /pairs/ID, which stops and removes a pair, and
+// POST /pairs/ID/rescan.
+func servePair(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/pairs/"), "/")
+
+	pairs.Lock()
+	p, ok := pairs.byID[parts[0]]
+	var cur pair
+	if ok {
+		cur = *p
+	}
+	pairs.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, cur)
+	case len(parts) == 1 && r.Method == "DELETE":
+		p.stop()
+
+		pairs.Lock()
+		delete(pairs.byID, p.ID)
+		pairs.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "rescan" && r.Method == "POST":
+		if _, err := io.WriteString(cur.control, "rescan\n"); err != nil {
+			http.Error(w, "pair isn't running", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// authorized reports if r may use the pair API, which takes a verified
+// client certificate or the -api-token, and otherwise answers it.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if apiToken == "" {
+		http.Error(w, "the pair API needs -api-token or -tls-client-ca", http.StatusForbidden)
+		return false
+	}
+
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// checkPairArgs errors if args has anything but flags in pairArgs and
+// their values.
+func checkPairArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			return errors.Errorf("unexpected argument %q", arg)
+		}
+
+		name := strings.TrimLeft(arg, "-")
+
+		var value bool
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value = name[:eq], true
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || !pairArgs[name] {
+			return errors.Errorf("flag -%s can't be set on a pair through the API", name)
+		}
+
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !value && !(ok && b.IsBoolFlag()) {
+			i++
+		}
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// restartPolicy reports if policy is one a pair can have.
+func restartPolicy(policy string) bool {
+	switch policy {
+	case "never", "on-failure", "always":
+		return true
+	}
+
+	return false
+}
+
+// startPair starts a child sync from src to dest and a goroutine
+// supervising it.
+func startPair(src, dest string, args []string, restart string) (*pair, error) {
+	pairs.Lock()
+	pairs.next++
+	id := strconv.Itoa(pairs.next)
+	pairs.Unlock()
+
+	p := &pair{
+		ID:       id,
+		Src:      src,
+		Dest:     dest,
+		Args:     args,
+		Restart:  restart,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	out, err := p.spawn()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.supervise(out)
+
+	pairs.Lock()
+	pairs.byID[id] = p
+	pairs.Unlock()
+
+	return p, nil
+}
+
+// configArgs returns the settings of the config file and its -profile as
+// flags for a pair, ahead of the pair's own args, which override them.
+func configArgs() []string {
+	names := make([]string, 0, len(configValues))
+	for name := range configValues {
+		if !daemonOnly[name] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range configValues[name] {
+			args = append(args, "-"+name+"="+value)
+		}
+	}
+
+	return args
+}
+
+// spawn starts a child sync for the pair, returning its stderr.
+func (p *pair) spawn() (io.Reader, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding executable")
+	}
+
+	argv := append([]string{"-src", p.Src, "-dest", p.Dest, "-control-stdin"}, configArgs()...)
+	argv = append(argv, p.Args...)
+
+	cmd := exec.Command(exe, argv...)
+	cmd.Stdout = os.Stdout
+
+	control, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "starting pair")
+	}
+
+	pairs.Lock()
+	p.cmd = cmd
+	p.control = control
+	p.Pid = cmd.Process.Pid
+	p.Started = time.Now()
+	p.Health = "running"
+	stopping := p.isStopping()
+	pairs.Unlock()
+
+	log.Printf("Started pair %s: %s -> %s (pid %d)", p.ID, p.Src, p.Dest, p.Pid)
+
+	// A stop that came in while this was starting missed it.
+	if stopping {
+		interruptChild(cmd, control)
+	}
+
+	return out, nil
+}
+
+// supervise passes on the child's log lines, prefixed with the pair's id,
+// and restarts the child when it exits as the pair's restart policy says,
+// backing off while it keeps failing.
+func (p *pair) supervise(out io.Reader) {
+	defer close(p.done)
+
+	var (
+		backoff = *fBack
+		started = time.Now()
+		err     = p.wait(out)
+	)
+
+	for {
+		exited := "done"
+		if err != nil {
+			exited = err.Error()
+		}
+
+		log.Printf("Pair %s exited: %s", p.ID, exited)
+
+		restart := p.Restart == "always" || (p.Restart == "on-failure" && err != nil)
+
+		pairs.Lock()
+		p.Exited = exited
+		if restart && !p.isStopping() {
+			p.Health = "restarting"
+		} else if err != nil && !p.isStopping() {
+			p.Health = "failed"
+		} else {
+			p.Health = "stopped"
+		}
+		health := p.Health
+		pairs.Unlock()
+
+		if health != "restarting" {
+			return
+		}
+
+		if time.Since(started) >= restartReset {
+			backoff = *fBack
+		}
+
+		log.Printf("Restarting pair %s in %s", p.ID, backoff)
+
+		select {
+		case <-p.stopping:
+			pairs.Lock()
+			p.Health = "stopped"
+			pairs.Unlock()
+
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+
+		pairs.Lock()
+		p.Restarts++
+		pairs.Unlock()
+
+		started = time.Now()
+
+		if out, err = p.spawn(); err == nil {
+			err = p.wait(out)
+		}
+	}
+}
+
+// wait logs the child's output until it exits.
+func (p *pair) wait(out io.Reader) error {
+	// Wait closes the pipe, so the output has to be read first.
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		log.Printf("[%s] %s", p.ID, scanner.Text())
+	}
+
+	pairs.Lock()
+	cmd := p.cmd
+	pairs.Unlock()
+
+	return cmd.Wait()
+}
+
+// isStopping reports if stop has been called. pairs must be locked.
+func (p *pair) isStopping() bool {
+	select {
+	case <-p.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop interrupts the pair's sync and waits for it to exit, killing it if
+// it takes too long. It won't be restarted.
+func (p *pair) stop() {
+	pairs.Lock()
+	if !p.isStopping() {
+		close(p.stopping)
+	}
+	cmd, control := p.cmd, p.control
+	pairs.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	interruptChild(cmd, control)
+
+	select {
+	case <-p.done:
+	case <-time.After(10 * time.Second):
+		log.Printf("Pair %s didn't exit, killing it", p.ID)
+		cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// interruptChild asks a child sync to exit.
+func interruptChild(cmd *exec.Cmd, control io.WriteCloser) {
+	// Windows can't deliver an interrupt, so close stdin there instead,
+	// which -control-stdin takes as a request to exit.
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		control.Close()
+	}
+}
+
+// readControl takes commands for the run loop from stdin, one per line,
+// for a daemon running this sync as a pair. End of input means exit.
+func readControl(cancel chan os.Signal) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		switch cmd := strings.TrimSpace(scanner.Text()); cmd {
+		case "rescan":
+			go func() {
+				if err := requestRescan(context.Background()); err != nil {
+					log.Printf("Rescan failed: %s", err)
+				}
+			}()
+		case "":
+		default:
+			log.Printf("Unknown control command: %s", cmd)
+		}
+	}
+
+	select {
+	case cancel <- os.Interrupt:
+	default:
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// syncState tracks what the syncer is doing right now, for the debug
+// dump.
+type syncState struct {
+	mu sync.Mutex
+
+	phase   string
+	op      string
+	path    string
+	since   time.Time
+	handled int64
+	queued  int
+
+	// queue is the event queue being used by run.
+	queue *eventQueue
+}
+
+var state syncState
+
+func (s *syncState) setPhase(phase string) {
+	s.mu.Lock()
+	s.phase = phase
+	s.mu.Unlock()
+}
+
+// begin records that op is now being performed on path.
+func (s *syncState) begin(op, path string) {
+	s.mu.Lock()
+	s.op = op
+	s.path = path
+	s.since = time.Now()
+	s.mu.Unlock()
+}
+
+// end records that the current op is done.
+func (s *syncState) end() {
+	s.mu.Lock()
+	s.op = ""
+	s.path = ""
+	s.handled++
+	s.mu.Unlock()
+}
+
+// setQueued records how many events are waiting to be applied.
+func (s *syncState) setQueued(n int) {
+	s.mu.Lock()
+	s.queued = n
+	s.mu.Unlock()
+}
+
+func (s *syncState) setQueue(q *eventQueue) {
+	s.mu.Lock()
+	s.queue = q
+	s.mu.Unlock()
+}
+
+// currentStatus returns the current state as a map, for the APIs.
+func currentStatus() map[string]interface{} {
+	state.mu.Lock()
+
+	st := map[string]interface{}{
+		"src":     *fSrc,
+		"dest":    *fDest,
+		"phase":   state.phase,
+		"op":      state.op,
+		"path":    state.path,
+		"handled": state.handled,
+	}
+
+	queued, queue := state.queued, state.queue
+
+	state.mu.Unlock()
+
+	if queue != nil {
+		queued += len(queue.c)
+	}
+
+	st["queued"] = queued
+
+	failures.Lock()
+	st["retrying"] = len(failures.retrying)
+	st["dead_letters"] = len(failures.dead)
+	failures.Unlock()
+
+	u := currentUsage()
+	st["watches"] = u.watches
+	st["open_files"] = u.files
+	st["goroutines"] = u.goroutines
+
+	return st
+}
+
+// dump writes the current state and failing paths followed by all
+// goroutine stacks to w.
+func (s *syncState) dump(w io.Writer) {
+	s.mu.Lock()
+
+	fmt.Fprintf(w, "phase: %s\n", s.phase)
+
+	if s.op != "" {
+		fmt.Fprintf(w, "current: %s %s (%s elapsed)\n", s.op, s.path, time.Since(s.since))
+	} else {
+		fmt.Fprintf(w, "current: idle\n")
+	}
+
+	fmt.Fprintf(w, "handled: %d\n", s.handled)
+
+	queue := s.queue
+
+	s.mu.Unlock()
+
+	if queue != nil {
+		queue.dump(w)
+	}
+
+	dumpFailures(w)
+
+	u := currentUsage()
+	fmt.Fprintf(w, "watches: %d (limit %d)\n", u.watches, u.maxWatches)
+	fmt.Fprintf(w, "open files: %d (limit %d)\n", u.files, u.maxFiles)
+	fmt.Fprintf(w, "goroutines: %d\n\n", u.goroutines)
+
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// startDebug serves pprof, the state dump and the event stream on addr.
+func startDebug(addr string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+
+	mux.HandleFunc("/debug/sync", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		state.dump(w)
+	})
+
+	mux.HandleFunc("/debug/sync/events", serveEvents)
+
+	go func() {
+		log.Printf("Serving debug endpoints on %s", addr)
+
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Debug server failed: %s", err)
+		}
+	}()
+}
+
+// dumpState writes the state dump to stderr.
+func dumpState() {
+	log.Printf("Dumping state")
+	state.dump(os.Stderr)
+}
@@ -0,0 +1,5 @@
+package main
+
+// watchDumpSignal is a no-op, Windows has no SIGUSR1. Use -debug-addr
+// and /debug/sync instead.
+func watchDumpSignal() {}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deferCheck is how often deferred copies are retried.
+const deferCheck = time.Second
+
+// deferred holds the files whose copy has been put off until they're in a
+// state worth copying. noted tracks which of them have been logged, so a
+// file deferred over and over is only logged once.
+var deferred = struct {
+	sync.Mutex
+	paths map[string]bool
+	noted map[string]bool
+}{
+	paths: make(map[string]bool),
+	noted: make(map[string]bool),
+}
+
+// deferCopy puts off copying rel until the next retry.
+func deferCopy(rel, why string) {
+	deferred.Lock()
+	defer deferred.Unlock()
+
+	if !deferred.noted[rel] {
+		log.Printf("Deferring %s, %s", rel, why)
+		deferred.noted[rel] = true
+	}
+
+	deferred.paths[rel] = true
+}
+
+// retryDeferred attempts the copy of every deferred file again. Files
+// that still aren't ready are deferred again.
+func retryDeferred() {
+	deferred.Lock()
+
+	paths := make([]string, 0, len(deferred.paths))
+	for rel := range deferred.paths {
+		paths = append(paths, rel)
+	}
+
+	deferred.paths = make(map[string]bool)
+
+	deferred.Unlock()
+
+	sort.Strings(paths)
+
+	defer func() {
+		deferred.Lock()
+		for _, rel := range paths {
+			if !deferred.paths[rel] {
+				delete(deferred.noted, rel)
+			}
+		}
+		deferred.Unlock()
+	}()
+
+	for _, rel := range paths {
+		if _, err := os.Lstat(filepath.Join(*fSrc, rel)); err != nil {
+			forgetSettling(rel)
+			continue
+		}
+
+		ctx := withOp(context.Background())
+
+		if err := copyFile(ctx, rel, true); err != nil {
+			publishError(rel, err)
+			recordFailure(ctx, rel, err)
+			continue
+		}
+
+		journal.done(rel)
+	}
+}
+
+type fileStat struct {
+	size  int64
+	mtime time.Time
+}
+
+// same reports if s and o are the same size with the same mtime.
+func (s fileStat) same(o fileStat) bool {
+	return s.size == o.size && s.mtime.Equal(o.mtime)
+}
+
+type settleCheck struct {
+	stat fileStat
+	at   time.Time
+}
+
+// settling holds the last stat seen of files being checked for growth.
+var settling = struct {
+	sync.Mutex
+	seen map[string]settleCheck
+}{seen: make(map[string]settleCheck)}
+
+// settled reports if fi matches the stat seen for rel at least deferCheck
+// ago, ie the file has stopped growing. Otherwise fi is remembered for the
+// next check.
+func settled(rel string, fi os.FileInfo) bool {
+	settling.Lock()
+	defer settling.Unlock()
+
+	cur := fileStat{size: fi.Size(), mtime: fi.ModTime()}
+
+	if prev, ok := settling.seen[rel]; ok && prev.stat.same(cur) {
+		if time.Since(prev.at) < deferCheck {
+			return false
+		}
+
+		delete(settling.seen, rel)
+		return true
+	}
+
+	settling.seen[rel] = settleCheck{stat: cur, at: time.Now()}
+
+	return false
+}
+
+// isDeferred reports if copying rel has been put off.
+func isDeferred(rel string) bool {
+	deferred.Lock()
+	defer deferred.Unlock()
+
+	return deferred.paths[rel]
+}
+
+// isSettling reports if rel is being checked for growth.
+func isSettling(rel string) bool {
+	settling.Lock()
+	defer settling.Unlock()
+
+	_, ok := settling.seen[rel]
+
+	return ok
+}
+
+func forgetSettling(rel string) {
+	settling.Lock()
+	delete(settling.seen, rel)
+	settling.Unlock()
+}
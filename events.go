@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventKind is the kind of change a syncEvent reports.
+type eventKind int
+
+const (
+	eventCopied eventKind = iota
+	eventRemoved
+	eventChmodded
+	eventErrored
+	eventInitialSyncDone
+)
+
+var eventKindNames = map[eventKind]string{
+	eventCopied:          "copied",
+	eventRemoved:         "removed",
+	eventChmodded:        "chmodded",
+	eventErrored:         "errored",
+	eventInitialSyncDone: "initial-sync-done",
+}
+
+func (k eventKind) String() string {
+	return eventKindNames[k]
+}
+
+func (k eventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// syncEvent reports a change made to the destination.
+type syncEvent struct {
+	Kind  eventKind `json:"kind"`
+	Path  string    `json:"path,omitempty"`
+	Bytes int64     `json:"bytes,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+
+	// Op is the operation id of the file action, to tell its events from
+	// those of others running at the same time.
+	Op uint64 `json:"op,omitempty"`
+}
+
+// eventBacklog is how many events a subscriber can fall behind by before
+// events are dropped for it.
+const eventBacklog = 1024
+
+// bus fans sync events out to subscribers and callbacks. Publishing never
+// blocks on a slow subscriber.
+var bus struct {
+	sync.Mutex
+	subs      map[chan syncEvent]bool
+	callbacks map[eventKind][]func(syncEvent)
+}
+
+// subscribe returns a channel receiving every event published from now
+// on, and a func to stop receiving them.
+func subscribe() (<-chan syncEvent, func()) {
+	c := make(chan syncEvent, eventBacklog)
+
+	bus.Lock()
+	if bus.subs == nil {
+		bus.subs = make(map[chan syncEvent]bool)
+	}
+	bus.subs[c] = true
+	bus.Unlock()
+
+	return c, func() {
+		bus.Lock()
+		if bus.subs[c] {
+			delete(bus.subs, c)
+			close(c)
+		}
+		bus.Unlock()
+	}
+}
+
+// onEvent registers fn to be called with every event of kind. Callbacks
+// run synchronously on the syncing goroutine, so they must be quick.
+func onEvent(kind eventKind, fn func(syncEvent)) {
+	bus.Lock()
+	if bus.callbacks == nil {
+		bus.callbacks = make(map[eventKind][]func(syncEvent))
+	}
+	bus.callbacks[kind] = append(bus.callbacks[kind], fn)
+	bus.Unlock()
+}
+
+func publish(ev syncEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	bus.Lock()
+
+	callbacks := bus.callbacks[ev.Kind]
+
+	for c := range bus.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+
+	bus.Unlock()
+
+	for _, fn := range callbacks {
+		fn(ev)
+	}
+}
+
+// publishError publishes the failure of rel, counting it toward the
+// -notify-errors rate here rather than through the bus, which may drop
+// it.
+func publishError(rel string, err error) {
+	ev := syncEvent{Kind: eventErrored, Path: rel, Error: err.Error(), Time: time.Now()}
+
+	publish(ev)
+
+	if len(notifiers) > 0 {
+		countError(ev)
+	}
+}
+
+// serveEvents streams events as JSON lines until the client goes away.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	events, cancel := subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retryBase is the wait before the first retry of a failed path. It
+// doubles with each attempt after that.
+const retryBase = time.Second
+
+type failure struct {
+	attempts int
+	next     time.Time
+	err      error
+}
+
+// failures holds the paths that failed to sync. Those in retrying are
+// tried again once their backoff is up; those in dead have used up their
+// retries and wait for the next rescan.
+var failures = struct {
+	sync.Mutex
+	retrying map[string]*failure
+	dead     map[string]*failure
+}{
+	retrying: make(map[string]*failure),
+	dead:     make(map[string]*failure),
+}
+
+// recordFailure notes that syncing rel failed with err, scheduling a retry
+// or, once -retries is used up, moving it to the dead letters.
+func recordFailure(ctx context.Context, rel string, err error) {
+	failures.Lock()
+	defer failures.Unlock()
+
+	if f, ok := failures.dead[rel]; ok {
+		f.err = err
+		return
+	}
+
+	f, ok := failures.retrying[rel]
+	if !ok {
+		f = &failure{}
+		failures.retrying[rel] = f
+	}
+
+	f.attempts++
+	f.err = err
+
+	if f.attempts > *fRtry {
+		opLogf(ctx, "Giving up on %s after %d attempts: %s", rel, f.attempts, err)
+
+		delete(failures.retrying, rel)
+		failures.dead[rel] = f
+
+		return
+	}
+
+	wait := retryBase << uint(f.attempts-1)
+	f.next = time.Now().Add(wait)
+
+	opLogf(ctx, "Failed to sync %s, retrying in %s: %s", rel, wait, err)
+}
+
+// clearFailure forgets any failure recorded for rel.
+func clearFailure(rel string) {
+	failures.Lock()
+	delete(failures.retrying, rel)
+	delete(failures.dead, rel)
+	failures.Unlock()
+}
+
+// retryFailed syncs every failed path whose backoff is up again.
+func retryFailed(w watcher) {
+	now := time.Now()
+
+	failures.Lock()
+
+	var paths []string
+	for rel, f := range failures.retrying {
+		if !now.Before(f.next) {
+			paths = append(paths, rel)
+		}
+	}
+
+	failures.Unlock()
+
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		ctx := withOp(context.Background())
+
+		if err := resync(ctx, rel, w); err != nil {
+			publishError(rel, err)
+			recordFailure(ctx, rel, err)
+			continue
+		}
+
+		opLogf(ctx, "Recovered %s", rel)
+		clearFailure(rel)
+		journal.done(rel)
+	}
+}
+
+// reviveDead gives the dead letters a fresh set of retries.
+func reviveDead() {
+	failures.Lock()
+	defer failures.Unlock()
+
+	for rel, f := range failures.dead {
+		f.attempts = 0
+		f.next = time.Now()
+
+		failures.retrying[rel] = f
+	}
+
+	failures.dead = make(map[string]*failure)
+}
+
+// resync brings rel in the destination up to date with the source,
+// whatever the event that failed was.
+func resync(ctx context.Context, rel string, w watcher) error {
+	from := filepath.Join(*fSrc, rel)
+
+	fi, err := os.Lstat(from)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return removeEntry(rel, w)
+		}
+
+		return err
+	}
+
+	if fi.IsDir() {
+		if err = os.MkdirAll(destDir(rel), fi.Mode()); err != nil {
+			return err
+		}
+
+		return watchDir(w, from, fi)
+	}
+
+	if err = createEntry(ctx, rel, w); err != nil {
+		return err
+	}
+
+	return syncMetadata(ctx, rel)
+}
+
+// resyncTree is resync for rel and everything below it, recording the
+// paths that fail to be retried.
+func resyncTree(ctx context.Context, rel string, w watcher) {
+	t := &treeSync{w: w, roots: liveRoots(), dirs: newDirSpans(ctx)}
+	defer t.dirs.close()
+
+	err := walkTree(filepath.Join(*fSrc, rel), nil, func(path, rel string, fi os.FileInfo) error {
+		if err := t.visit(path, rel, fi); err != nil {
+			publishError(rel, err)
+			recordFailure(ctx, rel, err)
+		}
+
+		return nil
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		publishError(rel, err)
+		recordFailure(ctx, rel, err)
+	}
+}
+
+// dumpFailures writes the failing and dead letter paths to w.
+func dumpFailures(w io.Writer) {
+	failures.Lock()
+	defer failures.Unlock()
+
+	dump := func(name string, m map[string]*failure) {
+		fmt.Fprintf(w, "%s: %d\n", name, len(m))
+
+		paths := make([]string, 0, len(m))
+		for rel := range m {
+			paths = append(paths, rel)
+		}
+
+		sort.Strings(paths)
+
+		for _, rel := range paths {
+			fmt.Fprintf(w, "  %s (%d attempts): %s\n", rel, m[rel].attempts, m[rel].err)
+		}
+	}
+
+	dump("retrying", failures.retrying)
+	dump("dead letters", failures.dead)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+)
+
+// With -fake-super, the metadata only root can set is kept in an xattr on
+// each destination entry, as rsync's --fake-super does. Devices, fifos
+// and sockets are stood in for by empty files. A sync run as root from
+// such a tree with -restore-fake-super restores the real thing.
+
+// standIn puts an empty file at to for a device, fifo or socket that
+// -fake-super records the details of.
+func standIn(to string) error {
+	if fi, err := os.Lstat(to); err == nil && !fi.Mode().IsRegular() {
+		os.RemoveAll(to)
+	}
+
+	f, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// restoreTree restores what -fake-super recorded in the source across the
+// destination, for the tar stream, which doesn't carry xattrs. A source
+// with nothing recorded on its root is taken to have nothing recorded.
+func restoreTree(r syncRoots, cancel chan os.Signal) error {
+	if !*fUnfk {
+		return nil
+	}
+
+	if ok, err := restoreFakeSuper(r.src, r.dest); !ok || err != nil {
+		return err
+	}
+
+	return walkFrom(r.src, r.src, cancel, func(path, rel string, fi os.FileInfo) error {
+		_, err := restoreFakeSuper(path, r.to(rel))
+		return err
+	})
+}
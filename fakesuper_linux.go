@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	fakeSuperSupported = true
+	fakeSuperAttr      = "user.sync.stat"
+)
+
+// storeFakeSuper records the type, mode, device and owner of the source
+// entry fi in the xattr of the destination entry at to.
+func storeFakeSuper(to string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+
+	// Linux doesn't allow user xattrs on symlinks, their owner is lost.
+	if !ok || fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return nil
+	}
+
+	v := fmt.Sprintf("%o %d %d:%d", st.Mode, st.Rdev, uidMap.shift(int(st.Uid)), gidMap.shift(int(st.Gid)))
+
+	err := unix.Lsetxattr(to, fakeSuperAttr, []byte(v), 0)
+	if err != nil && !os.IsNotExist(err) {
+		return &os.PathError{Op: "setxattr", Path: to, Err: err}
+	}
+
+	return nil
+}
+
+// restoreFakeSuper applies the metadata recorded in the xattr of the
+// source entry at from to the destination entry at to, making stand-ins
+// into the devices they stand for. It reports if there was any.
+//
+// Anyone who can write the source can set the xattr, so unless the source
+// entry is owned by root, setuid and setgid are dropped and devices are
+// left as stand-ins.
+func restoreFakeSuper(from, to string) (bool, error) {
+	buf := make([]byte, 64)
+
+	n, err := unix.Lgetxattr(from, fakeSuperAttr, buf)
+	if err != nil {
+		return false, nil
+	}
+
+	var (
+		mode     uint32
+		rdev     uint64
+		uid, gid int
+	)
+
+	if _, err = fmt.Sscanf(string(buf[:n]), "%o %d %d:%d", &mode, &rdev, &uid, &gid); err != nil {
+		return false, fmt.Errorf("bad %s on %s: %s", fakeSuperAttr, from, err)
+	}
+
+	var st unix.Stat_t
+
+	if err = unix.Lstat(from, &st); err != nil {
+		return false, &os.PathError{Op: "lstat", Path: from, Err: err}
+	}
+
+	if st.Uid != 0 {
+		if mode&(unix.S_ISUID|unix.S_ISGID) != 0 {
+			log.Printf("Not restoring setuid/setgid on %s, %s isn't owned by root", to, from)
+			mode &^= unix.S_ISUID | unix.S_ISGID
+		}
+
+		if t := mode & unix.S_IFMT; t == unix.S_IFCHR || t == unix.S_IFBLK {
+			log.Printf("Not restoring device %s, %s isn't owned by root", to, from)
+			mode = mode&^unix.S_IFMT | unix.S_IFREG
+		}
+	}
+
+	switch mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK, unix.S_IFIFO, unix.S_IFSOCK:
+		os.Remove(to)
+
+		if err = unix.Mknod(to, mode, int(rdev)); err != nil {
+			return true, &os.PathError{Op: "mknod", Path: to, Err: err}
+		}
+	}
+
+	if err = unix.Lchown(to, uid, gid); err != nil {
+		return true, &os.PathError{Op: "chown", Path: to, Err: err}
+	}
+
+	// Chown clears setuid and setgid, so the mode goes on after.
+	if err = unix.Chmod(to, mode&07777); err != nil {
+		return true, &os.PathError{Op: "chmod", Path: to, Err: err}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// -fake-super needs Linux's user xattrs.
+const fakeSuperSupported = false
+
+func storeFakeSuper(to string, fi os.FileInfo) error {
+	return nil
+}
+
+func restoreFakeSuper(from, to string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MODIFY | unix.FAN_ATTRIB |
+	unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_ONDIR
+
+// fanotifyWatcher watches the whole filesystem holding the source with a
+// single fanotify mark, rather than one inotify watch per directory. It
+// needs CAP_SYS_ADMIN to mark and CAP_DAC_READ_SEARCH to resolve the
+// directory handles events are reported with.
+type fanotifyWatcher struct {
+	mu    sync.Mutex
+	root  string
+	f     *os.File
+	mount *os.File
+
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+}
+
+func newFanotifyWatcher() (watcher, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_REPORT_DFID_NAME|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK,
+		unix.O_RDONLY|unix.O_LARGEFILE)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fanotify_init")
+	}
+
+	return &fanotifyWatcher{
+		f:      os.NewFile(uintptr(fd), "fanotify"),
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (w *fanotifyWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *fanotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Add marks the filesystem holding path. Events are only reported for
+// paths inside the first path added; later paths inside it are covered.
+func (w *fanotifyWatcher) Add(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.root != "" {
+		if path == w.root || strings.HasPrefix(path, w.root+string(os.PathSeparator)) {
+			return nil
+		}
+
+		return errors.Errorf("%s is outside the watched tree %s", path, w.root)
+	}
+
+	mount, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = unix.FanotifyMark(int(w.f.Fd()), unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM,
+		fanotifyMask, unix.AT_FDCWD, path)
+	if err != nil {
+		mount.Close()
+		return errors.Wrapf(err, "fanotify_mark %s", path)
+	}
+
+	w.root = path
+	w.mount = mount
+
+	go w.loop()
+
+	return nil
+}
+
+// Remove is a no-op, a removed directory simply stops producing events.
+func (w *fanotifyWatcher) Remove(path string) error {
+	return nil
+}
+
+func (w *fanotifyWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+
+	close(w.done)
+
+	if w.mount != nil {
+		w.mount.Close()
+	}
+
+	return w.f.Close()
+}
+
+func (w *fanotifyWatcher) loop() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.sendError(errors.Wrapf(err, "reading fanotify events"))
+			}
+
+			return
+		}
+
+		if !w.parse(buf[:n]) {
+			return
+		}
+	}
+}
+
+// parse sends the events in buf. It returns false if the watcher was
+// closed.
+func (w *fanotifyWatcher) parse(buf []byte) bool {
+	for len(buf) >= unix.FAN_EVENT_METADATA_LEN {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if meta.Event_len < uint32(meta.Metadata_len) || int(meta.Event_len) > len(buf) {
+			return true
+		}
+
+		rec := buf[meta.Metadata_len:meta.Event_len]
+		buf = buf[meta.Event_len:]
+
+		if meta.Fd >= 0 {
+			unix.Close(int(meta.Fd))
+		}
+
+		if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			if !w.sendError(fsnotify.ErrEventOverflow) {
+				return false
+			}
+
+			continue
+		}
+
+		path, ok := w.resolve(rec)
+		if !ok || (path != w.root && !strings.HasPrefix(path, w.root+string(os.PathSeparator))) {
+			continue
+		}
+
+		ev := fsnotify.Event{Name: path}
+
+		switch {
+		case meta.Mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0:
+			ev.Op = fsnotify.Create
+		case meta.Mask&unix.FAN_DELETE != 0:
+			ev.Op = fsnotify.Remove
+		case meta.Mask&unix.FAN_MOVED_FROM != 0:
+			ev.Op = fsnotify.Rename
+		case meta.Mask&unix.FAN_MODIFY != 0:
+			ev.Op = fsnotify.Write
+		case meta.Mask&unix.FAN_ATTRIB != 0:
+			ev.Op = fsnotify.Chmod
+		default:
+			continue
+		}
+
+		select {
+		case w.events <- ev:
+		case <-w.done:
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolve turns the directory handle and name info record of an event
+// into a path.
+func (w *fanotifyWatcher) resolve(rec []byte) (string, bool) {
+	// struct fanotify_event_info_header, then the fsid, then a struct
+	// file_handle followed by the NUL terminated entry name.
+	const (
+		hdrLen    = 4
+		fsidLen   = 8
+		handleHdr = 8
+	)
+
+	for len(rec) >= hdrLen {
+		infoType := rec[0]
+		infoLen := int(binary.LittleEndian.Uint16(rec[2:4]))
+		if infoLen < hdrLen || infoLen > len(rec) {
+			return "", false
+		}
+
+		info := rec[:infoLen]
+		rec = rec[infoLen:]
+
+		if infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME || len(info) < hdrLen+fsidLen+handleHdr {
+			continue
+		}
+
+		fh := info[hdrLen+fsidLen:]
+		size := int(binary.LittleEndian.Uint32(fh[0:4]))
+		typ := int32(binary.LittleEndian.Uint32(fh[4:8]))
+		if handleHdr+size > len(fh) {
+			return "", false
+		}
+
+		name := fh[handleHdr+size:]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+
+		fd, err := unix.OpenByHandleAt(int(w.mount.Fd()), unix.NewFileHandle(typ, fh[handleHdr:handleHdr+size]), unix.O_RDONLY|unix.O_PATH)
+		if err != nil {
+			// The directory is already gone.
+			return "", false
+		}
+
+		dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+		unix.Close(fd)
+		if err != nil {
+			return "", false
+		}
+
+		if len(name) == 0 || string(name) == "." {
+			return dir, true
+		}
+
+		return filepath.Join(dir, string(name)), true
+	}
+
+	return "", false
+}
+
+func (w *fanotifyWatcher) sendError(err error) bool {
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
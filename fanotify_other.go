@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+func newFanotifyWatcher() (watcher, error) {
+	return nil, errors.New("the fanotify watcher is only available on Linux")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// nullWatcher watches nothing, for one-off syncs that exit when done.
+type nullWatcher struct{}
+
+func (nullWatcher) Add(string) error              { return nil }
+func (nullWatcher) Remove(string) error           { return nil }
+func (nullWatcher) Close() error                  { return nil }
+func (nullWatcher) Events() <-chan fsnotify.Event { return nil }
+func (nullWatcher) Errors() <-chan error          { return nil }
+
+// filesFromWait is how long -files-from waits on listed files that are
+// open for writing or still growing.
+const filesFromWait = 10 * time.Minute
+
+// runFilesFrom syncs just the paths listed by -files-from, relative to the
+// source and one per line, without walking either tree. A path that's gone
+// from the source is removed from the destination.
+func runFilesFrom() error {
+	var r io.Reader = os.Stdin
+
+	if *fFrom != "-" {
+		f, err := os.Open(*fFrom)
+		if err != nil {
+			return errors.Wrapf(err, "opening -files-from")
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	cancel := make(chan os.Signal, 1)
+	notifyInterrupt(cancel)
+
+	var (
+		w       nullWatcher
+		ctx     = context.Background()
+		synced  int
+		failed  int
+		waiting int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case <-cancel:
+			return errors.New("interrupted")
+		default:
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		rel := filepath.Clean(filepath.FromSlash(line))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			log.Printf("Skipping %s: not inside the source", line)
+			failed++
+			continue
+		}
+
+		if ignored(rel) {
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(destPath(rel)), 0755)
+		if err == nil {
+			err = resync(ctx, rel, w)
+		}
+
+		if err != nil {
+			log.Printf("Unable to sync %s: %s", rel, err)
+			publishError(rel, err)
+			failed++
+			continue
+		}
+
+		if isDeferred(rel) {
+			waiting++
+			continue
+		}
+
+		synced++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "reading -files-from")
+	}
+
+	// Files put off while open for writing or still growing are tried
+	// again until they're copied, or until filesFromWait runs out.
+	var (
+		left     int
+		deadline = time.After(filesFromWait)
+	)
+
+wait:
+	for waiting > 0 {
+		deferred.Lock()
+		n := len(deferred.paths)
+		deferred.Unlock()
+
+		if n == 0 {
+			left = 0
+			break
+		}
+
+		if n != left {
+			log.Printf("Waiting on %d listed paths still open or growing", n)
+			left = n
+		}
+
+		select {
+		case <-cancel:
+			return fmt.Errorf("interrupted with %d listed paths not synced", failed+left)
+		case <-deadline:
+			log.Printf("Gave up after %s on %d listed paths still open or growing", filesFromWait, left)
+			break wait
+		case <-time.After(deferCheck):
+		}
+
+		retryDeferred()
+	}
+
+	if waiting > 0 {
+		failures.Lock()
+		gaveUp := len(failures.retrying) + len(failures.dead) + left
+		failures.Unlock()
+
+		synced += waiting - gaveUp
+		failed += gaveUp
+	}
+
+	log.Printf("Synced %d listed paths", synced)
+
+	if failed > 0 {
+		return fmt.Errorf("%d listed paths failed to sync", failed)
+	}
+
+	return nil
+}
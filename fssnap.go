@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotWatcher is a watcher whose Add does nothing, for syncing from a
+// snapshot: the live tree is what's watched, and it's watched already.
+type snapshotWatcher struct {
+	watcher
+}
+
+func (snapshotWatcher) Add(string) error {
+	return nil
+}
+
+// fromSnapshot runs the initial sync fn from a -snapshot of the source, so
+// it copies a consistent image of it, with the snapshot as the source of
+// the roots it's given. The live tree is watched first, so
+// changes made after the snapshot are synced once fn is done.
+func fromSnapshot(w watcher, cancel chan os.Signal, fn func(w watcher, r syncRoots) error) error {
+	err := walkSource(cancel, func(path, rel string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			return watchDir(w, path, fi)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "watching source")
+	}
+
+	snap, release, err := takeSnapshot(*fSnap, *fSrc)
+	if err != nil {
+		return errors.Wrapf(err, "taking %s snapshot", *fSnap)
+	}
+
+	log.Printf("Syncing from %s snapshot at %s", *fSnap, snap)
+
+	err = fn(snapshotWatcher{w}, syncRoots{src: snap, dest: *fDest})
+
+	if rerr := release(); rerr != nil {
+		log.Printf("Unable to remove snapshot %s: %s", snap, rerr)
+	}
+
+	return err
+}
+
+// snapName is the name of a btrfs snapshot, which goes in the subvolume
+// it's of, since it can't be made across mounts.
+func snapName() string {
+	return fmt.Sprintf(".sync-snap-%d", os.Getpid())
+}
+
+// isSnapshot reports if rel is the snapshot of the source's own subvolume,
+// which isn't synced.
+func isSnapshot(rel string) bool {
+	return *fSnap != "" && filepath.Base(rel) == snapName()
+}
+
+// runCmd runs a snapshot tool, returning its trimmed output.
+func runCmd(name string, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(out.String()))
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// relToMount returns path relative to the mount point it's under.
+func relToMount(mount, path string) (string, error) {
+	rel, err := filepath.Rel(mount, path)
+	if err != nil {
+		return "", errors.Wrapf(err, "locating %s in %s", path, mount)
+	}
+
+	return rel, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// takeSnapshot takes an APFS local snapshot of the volume holding src and
+// mounts it read-only, returning where src is found in it and a func to
+// remove it.
+func takeSnapshot(kind, src string) (string, func() error, error) {
+	if kind != "apfs" {
+		return "", nil, fmt.Errorf("unsupported -snapshot on darwin: %s", kind)
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(src, &st); err != nil {
+		return "", nil, err
+	}
+
+	volume := string(bytes.TrimRight(st.Mntonname[:], "\x00"))
+
+	out, err := runCmd("tmutil", "localsnapshot", volume)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// tmutil prints "Created local snapshot with date: 2024-05-01-123456"
+	i := strings.LastIndex(out, ": ")
+	if i < 0 {
+		return "", nil, fmt.Errorf("unexpected tmutil output: %s", out)
+	}
+
+	date := strings.TrimSpace(out[i+2:])
+
+	dir, err := ioutil.TempDir("", "sync-snap-")
+	if err != nil {
+		runCmd("tmutil", "deletelocalsnapshots", date)
+		return "", nil, err
+	}
+
+	release := func() error {
+		runCmd("umount", dir)
+		os.Remove(dir)
+
+		_, err := runCmd("tmutil", "deletelocalsnapshots", date)
+		return err
+	}
+
+	snapshot := "com.apple.TimeMachine." + date + ".local"
+
+	if _, err = runCmd("mount_apfs", "-o", "ro", "-s", snapshot, volume, dir); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	rel, err := relToMount(volume, src)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return filepath.Join(dir, rel), release, nil
+}
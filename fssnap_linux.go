@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	btrfsMagic = 0x9123683e
+
+	// btrfsRootIno is the inode number of the root of every btrfs
+	// subvolume.
+	btrfsRootIno = 256
+)
+
+// takeSnapshot takes a read-only snapshot of the filesystem holding src,
+// returning where src is found in it and a func to remove it.
+func takeSnapshot(kind, src string) (string, func() error, error) {
+	switch kind {
+	case "btrfs":
+		return btrfsSnapshot(src)
+	case "lvm":
+		return lvmSnapshot(src)
+	default:
+		return "", nil, fmt.Errorf("unsupported -snapshot on linux: %s", kind)
+	}
+}
+
+// btrfsSnapshot snapshots the subvolume src is in, inside it. A snapshot
+// leaves out the subvolumes nested in the one taken, itself included.
+func btrfsSnapshot(src string) (string, func() error, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(src, &fs); err != nil {
+		return "", nil, err
+	}
+
+	if uint32(fs.Type) != btrfsMagic {
+		return "", nil, fmt.Errorf("%s isn't on btrfs", src)
+	}
+
+	subvol := src
+
+	for {
+		var st syscall.Stat_t
+		if err := syscall.Stat(subvol, &st); err != nil {
+			return "", nil, err
+		}
+
+		if st.Ino == btrfsRootIno {
+			break
+		}
+
+		parent := filepath.Dir(subvol)
+		if parent == subvol {
+			return "", nil, fmt.Errorf("%s isn't in a btrfs subvolume", src)
+		}
+
+		subvol = parent
+	}
+
+	snap := filepath.Join(subvol, snapName())
+
+	if _, err := runCmd("btrfs", "subvolume", "snapshot", "-r", subvol, snap); err != nil {
+		return "", nil, err
+	}
+
+	release := func() error {
+		_, err := runCmd("btrfs", "subvolume", "delete", snap)
+		return err
+	}
+
+	rel, err := relToMount(subvol, src)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return filepath.Join(snap, rel), release, nil
+}
+
+// lvmSnapshot snapshots the logical volume src is on and mounts the
+// snapshot read-only in a temporary directory.
+func lvmSnapshot(src string) (string, func() error, error) {
+	dev, mount, fstype, err := mountOf(src)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vg, err := runCmd("lvs", "--noheadings", "-o", "vg_name", dev)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := fmt.Sprintf("sync-snap-%d", os.Getpid())
+	snapdev := "/dev/" + strings.TrimSpace(vg) + "/" + name
+
+	if _, err = runCmd("lvcreate", "--snapshot", "--size", *fSnSz, "--name", name, dev); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		runCmd("lvremove", "-f", snapdev)
+		return "", nil, err
+	}
+
+	opts := "ro"
+
+	// XFS refuses to mount a filesystem whose UUID is already mounted.
+	if fstype == "xfs" {
+		opts += ",nouuid"
+	}
+
+	release := func() error {
+		runCmd("umount", dir)
+		os.Remove(dir)
+
+		_, err := runCmd("lvremove", "-f", snapdev)
+		return err
+	}
+
+	if _, err = runCmd("mount", "-o", opts, snapdev, dir); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	rel, err := relToMount(mount, src)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return filepath.Join(dir, rel), release, nil
+}
+
+// mountOf returns the device, mount point and filesystem type of the
+// mount holding path.
+func mountOf(path string) (string, string, string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", "", "", err
+	}
+
+	defer f.Close()
+
+	var dev, mount, fstype string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		mp := strings.Replace(fields[1], `\040`, " ", -1)
+
+		if !within(path, mp) && mp != "/" {
+			continue
+		}
+
+		if len(mp) >= len(mount) {
+			dev, mount, fstype = fields[0], mp, fields[2]
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return "", "", "", err
+	}
+
+	if mount == "" {
+		return "", "", "", errors.Errorf("no mount found for %s", path)
+	}
+
+	return dev, mount, fstype, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "fmt"
+
+// takeSnapshot fails, there's no snapshot support on this platform.
+func takeSnapshot(kind, src string) (string, func() error, error) {
+	return "", nil, fmt.Errorf("-snapshot %s isn't supported on this platform", kind)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitPatterns are the patterns of the gitignore -ignore files. As in git,
+// the last pattern matching a path decides whether it's ignored.
+var gitPatterns []stPattern
+
+// readGitignore reads the patterns of a .gitignore file. One inside the
+// source applies to the directory it's in, as in git.
+func readGitignore(file string) ([]stPattern, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	base := "."
+	if src, err := filepath.Abs(*fSrc); err == nil {
+		if abs, err := filepath.Abs(file); err == nil {
+			if rel, err := filepath.Rel(src, filepath.Dir(abs)); err == nil && !strings.HasPrefix(rel, "..") {
+				base = filepath.ToSlash(rel)
+			}
+		}
+	}
+
+	var (
+		patterns []stPattern
+		lineno   int
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimRight(scanner.Text(), " \t")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := parseGitPattern(line, base)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %q in %s", line, file)
+		}
+
+		p.source = fmt.Sprintf("%s:%d: %s", file, lineno, line)
+		patterns = append(patterns, p)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// parseGitPattern translates a gitignore line for the directory base. A
+// pattern with a slash before its end only matches from base, others at
+// any depth below it, and one ending in a slash only matches directories.
+func parseGitPattern(line, base string) (stPattern, error) {
+	var p stPattern
+
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.include = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	line = strings.TrimPrefix(line, "**/")
+	anchored := strings.Contains(line, "/")
+
+	re, err := stRegexp("/"+strings.TrimPrefix(line, "/"), false)
+	if err != nil {
+		return p, err
+	}
+
+	prefix := "^"
+	if base != "." {
+		prefix += regexp.QuoteMeta(base) + "/"
+	}
+
+	if !anchored {
+		prefix += "(?:.*/)?"
+	}
+
+	p.re, err = regexp.Compile(prefix + strings.TrimPrefix(re.String(), "^"))
+
+	return p, err
+}
+
+// gitMatch returns the last gitignore pattern matching rel, if any.
+func gitMatch(rel string) (stPattern, bool) {
+	rel = filepath.ToSlash(rel)
+
+	for i := len(gitPatterns) - 1; i >= 0; i-- {
+		if p := gitPatterns[i]; p.re.MatchString(rel) && (!p.dirOnly || gitDirMatch(p, rel)) {
+			return p, true
+		}
+	}
+
+	return stPattern{}, false
+}
+
+// gitDirMatch reports if rel matches the directory-only pattern p, which
+// it does if it's below a match or is a directory.
+func gitDirMatch(p stPattern, rel string) bool {
+	if parent := path.Dir(rel); parent != "." && p.re.MatchString(parent) {
+		return true
+	}
+
+	fi, err := os.Lstat(filepath.Join(*fSrc, filepath.FromSlash(rel)))
+
+	return err == nil && fi.IsDir()
+}
+
+// gitIgnored reports if the gitignore patterns exclude rel.
+func gitIgnored(rel string) bool {
+	p, ok := gitMatch(rel)
+
+	return ok && !p.include
+}
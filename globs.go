@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// globList is a flag holding globs, given more than once or separated by
+// commas.
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(value string) error {
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return err
+		}
+
+		*g = append(*g, glob)
+	}
+
+	return nil
+}
+
+// matches reports if any of the globs matches rel.
+func (g globList) matches(rel string) bool {
+	for _, glob := range g {
+		if matchGlob(glob, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchGlob matches glob against the slash separated form of rel. A glob
+// without a slash matches against the base name, so *.sh matches at any
+// depth.
+func matchGlob(glob, rel string) bool {
+	target := filepath.ToSlash(rel)
+	if !strings.ContainsRune(glob, '/') {
+		target = filepath.Base(rel)
+	}
+
+	ok, _ := filepath.Match(glob, target)
+
+	return ok
+}
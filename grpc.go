@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// The Sync service of sync.proto. Its messages are all well-known types,
+// so the service is described here by hand rather than generated.
+
+type syncServer interface {
+	StartSync(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	StreamEvents(*emptypb.Empty, grpc.ServerStream) error
+	GetStatus(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	TriggerRescan(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+}
+
+var syncServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sync.Sync",
+	HandlerType: (*syncServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "StartSync", Handler: unaryHandler("StartSync", func(s syncServer, ctx context.Context, in *emptypb.Empty) (interface{}, error) {
+			return s.StartSync(ctx, in)
+		})},
+		{MethodName: "GetStatus", Handler: unaryHandler("GetStatus", func(s syncServer, ctx context.Context, in *emptypb.Empty) (interface{}, error) {
+			return s.GetStatus(ctx, in)
+		})},
+		{MethodName: "TriggerRescan", Handler: unaryHandler("TriggerRescan", func(s syncServer, ctx context.Context, in *emptypb.Empty) (interface{}, error) {
+			return s.TriggerRescan(ctx, in)
+		})},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := new(emptypb.Empty)
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+
+				return srv.(syncServer).StreamEvents(in, stream)
+			},
+		},
+	},
+	Metadata: "sync.proto",
+}
+
+// unaryHandler adapts call, a method taking Empty, to a grpc.MethodDesc
+// handler.
+func unaryHandler(name string, call func(syncServer, context.Context, *emptypb.Empty) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(emptypb.Empty)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return call(srv.(syncServer), ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/sync.Sync/" + name}
+
+		return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(syncServer), ctx, req.(*emptypb.Empty))
+		})
+	}
+}
+
+// control is how the APIs drive the run loop.
+var control = struct {
+	// start is closed by StartSync to begin a -grpc-wait sync.
+	start     chan struct{}
+	startOnce sync.Once
+
+	// rescans takes requests for a rescan, each answered on the channel
+	// sent.
+	rescans chan chan error
+}{
+	start:   make(chan struct{}),
+	rescans: make(chan chan error),
+}
+
+type grpcServer struct{}
+
+func (grpcServer) StartSync(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty, error) {
+	started := true
+
+	if *fGWat {
+		control.startOnce.Do(func() {
+			close(control.start)
+			started = false
+		})
+	}
+
+	if started {
+		return nil, status.Error(codes.FailedPrecondition, "sync already started")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (grpcServer) StreamEvents(_ *emptypb.Empty, stream grpc.ServerStream) error {
+	events, cancel := subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			msg, err := structpb.NewStruct(map[string]interface{}{
+				"kind":  ev.Kind.String(),
+				"path":  ev.Path,
+				"bytes": ev.Bytes,
+				"error": ev.Error,
+				"time":  ev.Time.Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				return err
+			}
+
+			if err = stream.SendMsg(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (grpcServer) GetStatus(context.Context, *emptypb.Empty) (*structpb.Struct, error) {
+	return structpb.NewStruct(currentStatus())
+}
+
+func (grpcServer) TriggerRescan(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := requestRescan(ctx); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// requestRescan has the run loop rescan and waits for it to be done.
+func requestRescan(ctx context.Context) error {
+	done := make(chan error, 1)
+
+	select {
+	case control.rescans <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grpcAuthorized errors unless the call comes with a verified client
+// certificate or the -api-token as its bearer token.
+func grpcAuthorized(ctx context.Context) error {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return nil
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, v := range md.Get("authorization") {
+		got := strings.TrimPrefix(v, "Bearer ")
+		if apiToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) == 1 {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// startGRPC serves the Sync service on addr. Every call needs the
+// -api-token or a client certificate from -tls-client-ca, so one of them
+// must be set.
+func startGRPC(addr string) error {
+	cfg, err := serverTLS()
+	if err != nil {
+		return err
+	}
+
+	if err = readAPIToken(); err != nil {
+		return err
+	}
+
+	if apiToken == "" && *fCAs == "" {
+		return errors.New("-grpc-addr requires -api-token or -tls-client-ca")
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorized(ctx); err != nil {
+				return nil, err
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorized(ss.Context()); err != nil {
+				return err
+			}
+
+			return handler(srv, ss)
+		}),
+	}
+
+	if cfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening for grpc")
+	}
+
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&syncServiceDesc, grpcServer{})
+
+	go func() {
+		log.Printf("Serving grpc on %s", addr)
+
+		if err := s.Serve(l); err != nil {
+			log.Printf("gRPC server failed: %s", err)
+		}
+	}()
+
+	return nil
+}
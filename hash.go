@@ -0,0 +1,23 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// newHash returns a hash for comparing and storing content, of the -hash
+// algorithm. xxhash64 is the fastest but only guards against accidents;
+// blake3 is nearly as quick and, like sha256, collision resistant.
+func newHash() hash.Hash {
+	switch *fHash {
+	case "xxhash64":
+		return xxhash.New()
+	case "blake3":
+		return blake3.New(32, nil)
+	default:
+		return sha256.New()
+	}
+}
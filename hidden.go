@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+)
+
+var hiddenOK globList
+
+func init() {
+	flag.Var(&hiddenOK, "hidden-ok", "dotfile glob still synced with -skip-hidden (repeatable)")
+}
+
+// isHidden reports if rel is, or is inside, a dotfile or dot-directory
+// that -skip-hidden leaves out.
+func isHidden(rel string) bool {
+	if !*fHidn || rel == "." {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, ".") {
+			continue
+		}
+
+		if !hiddenOK.matches(filepath.Join(parts[:i+1]...)) {
+			return true
+		}
+	}
+
+	return false
+}
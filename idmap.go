@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var uidMap, gidMap idMap
+
+func init() {
+	flag.Var(&uidMap, "uid-map", "FROM:TO:COUNT to give the destination the source's owners, with uids FROM to FROM+COUNT-1 shifted to start at TO (repeatable)")
+	flag.Var(&gidMap, "gid-map", "FROM:TO:COUNT like -uid-map, for gids (repeatable)")
+}
+
+// idMap is a flag holding ranges of ids to shift, like a user namespace's
+// uid_map, given more than once or separated by commas.
+type idMap []idRange
+
+type idRange struct {
+	from, to, count int
+}
+
+func (m *idMap) String() string {
+	var parts []string
+	for _, r := range *m {
+		parts = append(parts, fmt.Sprintf("%d:%d:%d", r.from, r.to, r.count))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (m *idMap) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("expected FROM:TO:COUNT: %s", part)
+		}
+
+		var ids [3]int
+
+		for i, f := range fields {
+			n, err := strconv.Atoi(f)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid id in %s", part)
+			}
+
+			ids[i] = n
+		}
+
+		*m = append(*m, idRange{from: ids[0], to: ids[1], count: ids[2]})
+	}
+
+	return nil
+}
+
+// shift returns the id that id maps to. Ids outside every range are kept.
+func (m idMap) shift(id int) int {
+	for _, r := range m {
+		if id >= r.from && id < r.from+r.count {
+			return r.to + id - r.from
+		}
+	}
+
+	return id
+}
+
+// chownShifted gives the destination entry at to the owner uid and gid,
+// shifted by the maps. Ownership is only carried over when a map is given.
+func chownShifted(to string, uid, gid int) error {
+	if len(uidMap) == 0 && len(gidMap) == 0 {
+		return nil
+	}
+
+	err := os.Lchown(to, uidMap.shift(uid), gidMap.shift(gid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// ignoreFiles are the -ignore files, in the order given.
+var ignoreFiles fileList
+
+func init() {
+	flag.Var(&ignoreFiles, "ignore", "file with patterns to ignore, a .dockerignore, .gitignore or .stignore (repeatable, see -ignore-format)")
+}
+
+// fileList is a flag holding paths, given more than once or separated by
+// commas.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(value string) error {
+	for _, file := range strings.Split(value, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			*l = append(*l, file)
+		}
+	}
+
+	return nil
+}
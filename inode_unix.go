@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileInode returns the inode number of fi.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(st.Ino), true
+}
+
+// changeTime returns when the inode of the file at path, stat'ed as fi,
+// last changed, which a copy carrying over an old mtime can't hide.
+func changeTime(path string, fi os.FileInfo) time.Time {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return fi.ModTime()
+	}
+
+	return time.Unix(st.Ctim.Unix())
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileInode is unsupported, os.FileInfo carries no file index on Windows.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// changeTime is the mtime, Windows' change time isn't in os.FileInfo.
+func changeTime(path string, fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
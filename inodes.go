@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// copiedInodes holds the inode of the source file each path was last
+// synced from. Editors that save by writing a temp file and renaming it
+// over the original give the path a new inode, which counts as a change
+// even when the size and mtime compare equal, as they can within the
+// mtime granularity.
+var copiedInodes = struct {
+	sync.Mutex
+	m map[string]uint64
+}{m: make(map[string]uint64)}
+
+// inodeChanged reports if fi, the source of rel, isn't the file rel was
+// last synced from. A path not seen before is taken to be unchanged, and
+// its inode noted.
+func inodeChanged(rel string, fi os.FileInfo) bool {
+	ino, ok := fileInode(fi)
+	if !ok {
+		return false
+	}
+
+	copiedInodes.Lock()
+	defer copiedInodes.Unlock()
+
+	prev, seen := copiedInodes.m[rel]
+	if !seen {
+		copiedInodes.m[rel] = ino
+		return false
+	}
+
+	return prev != ino
+}
+
+// noteInode records that rel was synced from fi.
+func noteInode(rel string, fi os.FileInfo) {
+	if ino, ok := fileInode(fi); ok {
+		copiedInodes.Lock()
+		copiedInodes.m[rel] = ino
+		copiedInodes.Unlock()
+	}
+}
+
+// forgetInode drops what's recorded for rel, once it's removed.
+func forgetInode(rel string) {
+	copiedInodes.Lock()
+	delete(copiedInodes.m, rel)
+	copiedInodes.Unlock()
+}
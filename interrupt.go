@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// interrupts are the channels commands take interrupts on, so a stop from
+// the Windows service manager reaches them like a ^C would.
+var interrupts struct {
+	sync.Mutex
+	chans []chan os.Signal
+}
+
+// notifyInterrupt relays interrupts to c.
+func notifyInterrupt(c chan os.Signal) {
+	signal.Notify(c, os.Interrupt)
+
+	interrupts.Lock()
+	interrupts.chans = append(interrupts.chans, c)
+	interrupts.Unlock()
+}
+
+// interrupt delivers an interrupt to every channel passed to
+// notifyInterrupt.
+func interrupt() {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+
+	for _, c := range interrupts.chans {
+		select {
+		case c <- os.Interrupt:
+		default:
+		}
+	}
+}
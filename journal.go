@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The -journal file records the paths of events that were taken off the
+// queue but not yet applied, one line each: "+rel" when one is accepted
+// and "-rel" once it's applied. After a crash, the paths still pending are
+// resynced at startup, which catches changes the initial sync's size and
+// mtime compare can't see. Lines are written as events arrive and synced
+// to disk every deferCheck, so a crash of the sync loses none of them and
+// one of the machine only the last moments.
+
+type eventJournal struct {
+	mu      sync.Mutex
+	f       *os.File
+	pending map[string]bool
+	dirty   bool
+}
+
+// journal is the open -journal, or nil without one.
+var journal *eventJournal
+
+// openJournal opens the -journal file, returning the paths left pending
+// by the last run, sorted.
+func openJournal(path string) ([]string, error) {
+	pending := make(map[string]bool)
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			switch {
+			case strings.HasPrefix(line, "+"):
+				pending[line[1:]] = true
+			case strings.HasPrefix(line, "-"):
+				delete(pending, line[1:])
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading journal")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "opening journal")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening journal")
+	}
+
+	journal = &eventJournal{f: f, pending: pending}
+
+	rels := make([]string, 0, len(pending))
+	for rel := range pending {
+		rels = append(rels, rel)
+	}
+
+	sort.Strings(rels)
+
+	return rels, nil
+}
+
+// replayJournal resyncs the paths left pending by the last run, forgetting
+// each once it's done. Those that fail are retried like failed events.
+func replayJournal(rels []string, w watcher) {
+	if len(rels) == 0 {
+		return
+	}
+
+	log.Printf("Replaying %d paths from the journal", len(rels))
+
+	for _, rel := range rels {
+		if ignored(rel) {
+			journal.done(rel)
+			continue
+		}
+
+		ctx := withOp(context.Background())
+
+		if err := replay(ctx, rel, w); err != nil {
+			publishError(rel, err)
+			recordFailure(ctx, rel, err)
+			continue
+		}
+
+		journal.done(rel)
+	}
+}
+
+// replay resyncs rel. Files are copied whatever their size and mtime, as
+// the change that was missed needn't have touched either.
+func replay(ctx context.Context, rel string, w watcher) error {
+	fi, err := os.Lstat(filepath.Join(*fSrc, rel))
+	if err != nil || !fi.Mode().IsRegular() {
+		return resync(ctx, rel, w)
+	}
+
+	if err = copyFile(ctx, rel, true); err != nil {
+		return err
+	}
+
+	return syncMetadata(ctx, rel)
+}
+
+// accept records that an event for rel is waiting to be applied.
+func (j *eventJournal) accept(rel string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.pending[rel] {
+		return
+	}
+
+	j.pending[rel] = true
+	j.write("+" + rel)
+}
+
+// done records that the events for rel have been applied.
+func (j *eventJournal) done(rels ...string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, rel := range rels {
+		// A deferred copy is still to be applied.
+		if !j.pending[rel] || isDeferred(rel) {
+			continue
+		}
+
+		delete(j.pending, rel)
+		j.write("-" + rel)
+	}
+
+	// Once nothing is pending the history is of no use.
+	if len(j.pending) == 0 {
+		j.truncate()
+	}
+}
+
+// sync flushes what's been written since the last call to disk.
+func (j *eventJournal) sync() {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.dirty {
+		return
+	}
+
+	if err := j.f.Sync(); err != nil {
+		log.Printf("Error syncing journal: %s", err)
+	}
+
+	j.dirty = false
+}
+
+// write appends line to the journal. j must be locked.
+func (j *eventJournal) write(line string) {
+	if _, err := j.f.WriteString(line + "\n"); err != nil {
+		log.Printf("Error writing journal: %s", err)
+	}
+
+	j.dirty = true
+}
+
+// truncate empties the journal. j must be locked.
+func (j *eventJournal) truncate() {
+	if err := j.f.Truncate(0); err != nil {
+		log.Printf("Error truncating journal: %s", err)
+	}
+
+	j.dirty = true
+}
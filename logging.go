@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// logPriority is the severity of a log line, numbered like syslog's.
+type logPriority int
+
+const (
+	priCrit    logPriority = 2
+	priErr     logPriority = 3
+	priWarning logPriority = 4
+	priInfo    logPriority = 6
+)
+
+// logSink is a system logger that takes a priority with every line.
+type logSink interface {
+	writeLog(pri logPriority, msg string) error
+}
+
+// logOutput is where the log goes, restored by the displays that take it
+// over while they run.
+var logOutput io.Writer = os.Stderr
+
+// logWriter is the log's writer when it goes to a logSink.
+var logWriter *priorityWriter
+
+// setupLogging points the log at the -log-output destination.
+func setupLogging() error {
+	switch out := *fLogO; {
+	case out == "stderr":
+		return nil
+	case strings.HasPrefix(out, "file:"):
+		path := strings.TrimPrefix(out, "file:")
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "opening log file")
+		}
+
+		logOutput = f
+	case out == "syslog" || out == "journald":
+		sink, err := systemSink(out)
+		if err != nil {
+			return err
+		}
+
+		logWriter = &priorityWriter{sink: sink}
+		logOutput = logWriter
+
+		// The system logger timestamps lines itself.
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown -log-output: %s", out)
+	}
+
+	log.SetOutput(logOutput)
+
+	return nil
+}
+
+// fatal logs v at critical priority and exits.
+func fatal(v ...interface{}) {
+	if logWriter != nil {
+		logWriter.setNext(priCrit)
+	}
+
+	log.Fatal(v...)
+}
+
+// logPrefixes give the priority of log lines starting with them, anything
+// else is informational.
+var logPrefixes = []struct {
+	prefix string
+	pri    logPriority
+}{
+	{"Giving up", priErr},
+	{"verification found", priErr},
+	{"Debug server failed", priErr},
+	{"Failed", priWarning},
+	{"Unable", priWarning},
+	{"Refusing", priWarning},
+	{"Cowardly", priWarning},
+	{"Drift", priWarning},
+	{"Ignoring", priWarning},
+}
+
+func linePriority(msg string) logPriority {
+	for _, p := range logPrefixes {
+		if strings.HasPrefix(msg, p.prefix) {
+			return p.pri
+		}
+	}
+
+	return priInfo
+}
+
+// priorityWriter passes log lines to a logSink with a priority worked out
+// from the message.
+type priorityWriter struct {
+	mu   sync.Mutex
+	sink logSink
+	next logPriority
+}
+
+// setNext sets the priority of the next line written.
+func (w *priorityWriter) setNext(pri logPriority) {
+	w.mu.Lock()
+	w.next = pri
+	w.mu.Unlock()
+}
+
+func (w *priorityWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	msg := strings.TrimSuffix(string(p), "\n")
+
+	pri := w.next
+	if pri == 0 {
+		pri = linePriority(msg)
+	}
+
+	w.next = 0
+
+	if err := w.sink.writeLog(pri, msg); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
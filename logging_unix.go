@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// journalSocket is where journald takes native protocol messages.
+const journalSocket = "/run/systemd/journal/socket"
+
+// systemSink connects to syslog or journald.
+func systemSink(name string) (logSink, error) {
+	if name == "journald" {
+		conn, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return nil, errors.Wrapf(err, "connecting to journald")
+		}
+
+		return &journalSink{conn: conn}, nil
+	}
+
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "sync")
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to syslog")
+	}
+
+	return &syslogSink{w: w}, nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) writeLog(pri logPriority, msg string) error {
+	switch pri {
+	case priCrit:
+		return s.w.Crit(msg)
+	case priErr:
+		return s.w.Err(msg)
+	case priWarning:
+		return s.w.Warning(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+// journalSink writes to journald with its native protocol, which keeps
+// the priority as a field of its own.
+type journalSink struct {
+	conn net.Conn
+}
+
+func (s *journalSink) writeLog(pri logPriority, msg string) error {
+	var buf bytes.Buffer
+
+	journalField(&buf, "PRIORITY", strconv.Itoa(int(pri)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", "sync")
+	journalField(&buf, "MESSAGE", msg)
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// journalField appends a field, using the length prefixed form for
+// values that span lines.
+func journalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+// systemSink fails, Windows has neither syslog nor journald. Use
+// file:PATH instead.
+func systemSink(name string) (logSink, error) {
+	return nil, fmt.Errorf("-log-output %s isn't supported on Windows", name)
+}
@@ -1,119 +1,834 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 
 	ignore "github.com/codeskyblue/dockerignore"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	fSrc  = flag.String("src", "/src", "path with canonical files")
-	fDest = flag.String("dest", "/dest", "path to sync data to")
-	fIgn  = flag.String("ignore", "", "file with patterns to ignore")
+	fSrc  = flag.String("src", "/src", "path with canonical files, or - to extract a tar from stdin")
+	fDest = flag.String("dest", "/dest", "path to sync data to, rclone:REMOTE:PATH for an rclone remote, or - to write a tar to stdout")
+	fIgnF = flag.String("ignore-format", "auto", "dialect of the -ignore files: docker, gitignore, stignore or auto to go by their names")
+	fOTLP = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export trace spans to")
+	fDbg  = flag.String("debug-addr", "", "address to serve pprof, /debug/sync and /debug/sync/events on")
+	fTar  = flag.Bool("tar", false, "stream the initial sync through tar when the destination is empty and no per-file copy options are set")
+	fOut  = flag.String("out", "", "archive to write (snapshot)")
+	fIn   = flag.String("in", "", "archive to read (restore)")
+	fWtch = flag.Bool("watch", false, "sync and watch -src after restoring")
+	fCAS  = flag.Bool("cas", false, "store file contents once in a blob directory and hardlink them into the destination")
+	fBlob = flag.String("blob-dir", "", "blob directory for -cas (default DEST/.sync-blobs)")
+	fAtom = flag.Bool("atomic-dest", false, "perform the initial sync in DEST.new and atomically swap it into place")
+	fDbnc = flag.Duration("debounce", 0, "group events arriving within this window into a batch applied together")
+	fDefr = flag.Bool("defer-open", false, "put off copying files another process has open for writing until they're closed")
+	fSetl = flag.Int64("settle-min", 0, "only copy files of at least this many bytes once two stats a second apart agree (0 disables)")
+	fConf = flag.String("config", "", "file with flag settings, reloaded when it changes")
+	fProf = flag.String("profile", "", "profile of the -config file to apply, with its settings and pairs")
+	fSecr = flag.String("secrets", "off", "handling of secret files like .env and *.pem: off, refuse or redact")
+	fBknd = flag.String("watcher", "", "event backend: fsnotify, fanotify or windows (default "+defaultBackend+")")
+	fRtry = flag.Int("retries", 3, "times to retry a path that fails to sync before leaving it for the next rescan")
+	fRscn = flag.Duration("rescan", 0, "interval between full rescans of -src (0 disables)")
+	fRDif = flag.Bool("rescan-changed", false, "on -rescan, only read directories whose mtime changed since the last one (in-place writes are left to events)")
+	fVrfy = flag.Bool("verify-on-exit", false, "compare checksums of -src and -dest on shutdown and exit nonzero if they differ")
+	fTUI  = flag.Bool("tui", false, "show a live dashboard on the terminal instead of log lines")
+	fQuit = flag.Bool("quiet", false, "print a line per change instead of the full log")
+	fNoCl = flag.Bool("no-color", false, "don't color -quiet output")
+	fLogO = flag.String("log-output", "stderr", "where to log: stderr, syslog, journald or file:PATH")
+	fNtfy = flag.String("notify", "", "where to send failure notices: slack://HOOK-HOST/PATH or mailto:ADDR[,ADDR]?smtp=HOST:PORT, comma separated")
+	fNErr = flag.Int("notify-errors", 10, "errors in a minute that trigger a -notify notice")
+	fHidn = flag.Bool("skip-hidden", false, "skip dotfiles and dot-directories, except those matching -hidden-ok")
+	fSnap = flag.String("snapshot", "", "do the initial sync from a btrfs, lvm or apfs snapshot of -src")
+	fSnSz = flag.String("snapshot-size", "1G", "copy-on-write space to give an lvm -snapshot")
+	fGRPC = flag.String("grpc-addr", "", "address to serve the gRPC API of sync.proto on")
+	fGWat = flag.Bool("grpc-wait", false, "wait for a StartSync call on -grpc-addr before the initial sync")
+	fAPI  = flag.String("api-addr", "", "address to serve the pair API (daemon) or the destination (serve) on")
+	fATok = flag.String("api-token", "", "file holding a bearer token the pair and gRPC APIs require for every call (unless clients use mutual TLS)")
+	fRstr = flag.String("restart", "on-failure", "when the daemon restarts a pair that exits: never, on-failure or always")
+	fBack = flag.Duration("restart-backoff", time.Second, "delay before the daemon restarts a pair, doubling while it keeps failing, up to 5m")
+	fCtrl = flag.Bool("control-stdin", false, "take control commands, like rescan, on stdin; exit when it's closed")
+	fCert = flag.String("tls-cert", "", "certificate to serve -grpc-addr and -api-addr over TLS with, reloaded when it changes")
+	fKey  = flag.String("tls-key", "", "key for -tls-cert")
+	fCAs  = flag.String("tls-client-ca", "", "CA bundle client certificates must be signed by (mutual TLS)")
+	fPaus = flag.String("pause-file", ".sync-pause", "file at the root of -src that pauses writes to -dest while it exists, holding events until it's removed (empty to turn off)")
+	fComp = flag.Bool("compress-dest", false, "have the destination's filesystem compress what's synced, where it can (btrfs)")
+	fPLim = flag.String("path-limits", "skip", "for source paths too long for the destination: skip them, fail to start, or off to leave it to the filesystem")
+	fLong = flag.Bool("long-paths", false, "on Windows, allow destination paths past 260 characters, using \\\\?\\ paths")
+	fLOps = flag.Bool("log-ops", false, "end the log lines of each file action with its operation id, to follow one among parallel -workers")
+	fWarm = flag.String("warm-start", "", "fingerprint file for a destination filled by another tool: the first run gives files matching by content the source's mtime instead of copying them, recording them here")
+	fJrnl = flag.String("journal", "", "file to journal events in until they're applied, so those a crash left unapplied are resynced at startup")
+	fQueu = flag.Int("queue", 10000, "events to buffer before the overflow is collapsed into rescans of the directories involved")
+	fFrom = flag.String("files-from", "", "sync only the paths listed in this file, or - for stdin, then exit")
+	fMWin = flag.Duration("modify-window", 0, "treat mtimes this close together as equal, for clock skew between -src and -dest")
+	fGran = flag.Duration("mtime-granularity", 0, "resolution of -dest's mtimes, eg 2s for FAT (0 detects it)")
+	fHash = flag.String("hash", "sha256", "hash for -verify-on-exit and -cas: sha256, blake3 or xxhash64")
+	fNoCh = flag.Bool("ignore-chmod", false, "ignore Chmod events, leaving mode and ownership changes for rescans to pick up")
+	fFake = flag.Bool("fake-super", false, "keep owners, and devices as empty files, in xattrs on -dest for a later sync as root to restore")
+	fUnfk = flag.Bool("restore-fake-super", false, "as root, restore the owners, modes and devices -fake-super recorded in -src's xattrs")
+	fWMan = flag.String("write-manifest", "", "file to write a manifest of every file synced and its hash to, after the initial sync and on exit")
+	fMani = flag.String("manifest", "", "manifest to check -dest against (verify), or to give files' hashes as ETags (serve)")
+	fMKey = flag.String("manifest-key", "", "PEM ed25519 key: private to sign -write-manifest, public or private to check the signature in verify")
+	fExpl = flag.Bool("explain", false, "with check-ignore, print what ignores each path, and the paths that aren't ignored too")
+	fRcln = flag.String("rclone", "rclone", "rclone binary for a -dest of rclone:REMOTE:PATH")
+	fAuth = flag.String("serve-auth", "", "USER:PASSWORD clients of serve must give by basic auth")
+	fVWri = flag.Bool("verify-writes", false, "read each copied file back from disk before replacing the old one, retrying on a mismatch and leaving the old one in place if it persists")
+	fEmpt = flag.Bool("sync-empty", false, "treat empty files like any other, truncating the destination and carrying over mode and mtime")
+	fExec = flag.String("exec", "", "command to run in -dest after each batch of changes lands, with the changed paths on stdin (sets -debounce to 300ms if unset)")
+	fOvly = flag.Bool("overlay", false, "-src is an overlayfs upperdir: apply its whiteouts and opaque directories to -dest instead of pruning it")
+	fShrd = flag.Int("watch-shards", 1, "fsnotify watchers to spread the source's directories over, each with its own kernel queue")
+	fWork = flag.Int("workers", 1, "files to copy at once during the initial sync and rescans")
+	fRdyR = flag.Bool("ready-no-retries", false, "hold off on touching .synced until no paths are waiting to be retried")
+	fRdyC = flag.String("ready-cmd", "", "command that must exit 0, run in -dest, before .synced is touched; rerun until it does")
+	fWLim = flag.Int("warn-watches", 0, "warn when using this many inotify watches (0 is 80% of the system limit)")
+	fFLim = flag.Int("warn-files", 0, "warn when this many file descriptors are open (0 is 80% of the limit)")
+	fGLim = flag.Int("warn-goroutines", 0, "warn when running this many goroutines (0 disables)")
+	fPrbe = flag.Bool("probe-dest", true, "check what -dest's filesystem supports at startup, working around or turning off what needs something it lacks")
+	fSvcN = flag.String("service-name", "sync", "name of the Windows service or launchd agent to install, uninstall, start or stop")
 )
 
-var ignorePatterns []string
+var (
+	ignorePatterns []string
+
+	// ignoreSources are the files ignorePatterns came from, pattern by
+	// pattern.
+	ignoreSources []string
+)
+
+// commands can be given as the first argument to run something other than
+// the default sync and watch.
+var commands = map[string]func() error{
+	"snapshot":      runSnapshot,
+	"restore":       runRestore,
+	"daemon":        runDaemon,
+	"service":       runService,
+	"install-agent": installAgent,
+	"serve":         runServe,
+	"verify":        runManifestVerify,
+	"check-ignore":  runCheckIgnore,
+}
 
 func main() {
+	var cmd func() error
+
+	if len(os.Args) > 1 {
+		if c, ok := commands[os.Args[1]]; ok {
+			cmd = c
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	flag.Parse()
 
-	var err error
-	if *fIgn != "" {
-		ignorePatterns, err = ignore.ReadIgnoreFile(*fIgn)
-		if err != nil {
-			log.Fatal(err)
+	err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Dispatched after the config is loaded, so -src and -dest from it or
+	// its profile count.
+	if cmd == nil {
+		switch {
+		case *fDest == "-":
+			cmd = runTarOut
+		case *fSrc == "-":
+			cmd = runTarIn
+		case strings.HasPrefix(*fDest, rclonePrefix):
+			cmd = runRclone
+		case *fFrom != "":
+			cmd = runFilesFrom
+		default:
+			cmd = run
 		}
 	}
 
-	if err := run(); err != nil {
+	if err = setupLogging(); err != nil {
 		log.Fatal(err)
 	}
+
+	if err = loadIgnore(); err != nil {
+		fatal(err)
+	}
+
+	if err = setupNotify(); err != nil {
+		fatal(err)
+	}
+
+	if err = resolveSrc(); err != nil {
+		fatal(err)
+	}
+
+	switch *fSecr {
+	case "off", "refuse", "redact":
+	default:
+		fatal("unknown -secrets mode: ", *fSecr)
+	}
+
+	if *fExec != "" && *fDbnc == 0 {
+		*fDbnc = execDebounce
+	}
+
+	switch *fHash {
+	case "sha256", "blake3", "xxhash64":
+	default:
+		fatal("unknown -hash: ", *fHash)
+	}
+
+	if *fAtom && (*fRdyR || *fRdyC != "") {
+		fatal("-ready-no-retries and -ready-cmd can't be used with -atomic-dest")
+	}
+
+	if (*fFake || *fUnfk) && !fakeSuperSupported {
+		fatal("-fake-super is only supported on Linux")
+	}
+
+	if *fUnfk && (*fFake || os.Geteuid() != 0) {
+		fatal("-restore-fake-super needs to run as root, without -fake-super")
+	}
+
+	watchDumpSignal()
+
+	go watchResources()
+
+	if *fDbg != "" {
+		startDebug(*fDbg)
+	}
+
+	if *fGRPC != "" {
+		if err = startGRPC(*fGRPC); err != nil {
+			fatal(err)
+		}
+	}
+
+	shutdown, err := setupTracing()
+	if err != nil {
+		fatal(err)
+	}
+
+	stopOutput := func() {}
+
+	switch {
+	case *fTUI:
+		stopOutput = startTUI()
+	case *fQuit:
+		stopOutput = startQuiet()
+	}
+
+	err = asService(cmd)
+	stopOutput()
+	shutdown()
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// loadIgnore reads the patterns from the -ignore files. Files of the same
+// format are merged in the order given, as if they were one file, so for
+// docker and gitignore files a later file overrides an earlier one, and
+// for stignore files the earlier wins, as with #include. A path is
+// ignored if the files of any format ignore it.
+func loadIgnore() error {
+	var (
+		docker, sources []string
+		st, git         []stPattern
+	)
+
+	for _, file := range ignoreFiles {
+		format := *fIgnF
+		if format == "auto" {
+			format = ignoreFormat(file)
+		}
+
+		switch format {
+		case "docker":
+			patterns, err := ignore.ReadIgnoreFile(file)
+			if err != nil {
+				return err
+			}
+
+			for range patterns {
+				sources = append(sources, file)
+			}
+
+			docker = append(docker, patterns...)
+		case "gitignore":
+			patterns, err := readGitignore(file)
+			if err != nil {
+				return err
+			}
+
+			git = append(git, patterns...)
+		case "stignore":
+			patterns, err := readStignore(file)
+			if err != nil {
+				return err
+			}
+
+			st = append(st, patterns...)
+		default:
+			return fmt.Errorf("unknown -ignore-format: %s", format)
+		}
+	}
+
+	ignorePatterns, ignoreSources = docker, sources
+	stPatterns, gitPatterns = st, git
+
+	return nil
+}
+
+// ignoreFormat picks the format of an ignore file by its name, taking
+// anything unknown to be a .dockerignore.
+func ignoreFormat(file string) string {
+	switch filepath.Base(file) {
+	case ".gitignore", ".ignore":
+		return "gitignore"
+	case ".stignore":
+		return "stignore"
+	default:
+		return "docker"
+	}
 }
 
-func run() error {
+// ignored reports if rel is excluded from the sync, by the ignore
+// patterns, -skip-hidden or because it's a secret being refused.
+func ignored(rel string) bool {
+	if match, err := ignore.Matches(rel, ignorePatterns); err == nil && match {
+		return true
+	}
+
+	if stIgnored(rel) || gitIgnored(rel) || isPauseFile(rel) || isSnapshot(rel) || skipTooLong(rel) {
+		return true
+	}
+
+	if isHidden(rel) {
+		return true
+	}
+
+	return refuseSecret(rel)
+}
+
+// ignoredDir reports if the directory rel is ignored, or everything in it
+// would be, as with a node_modules/** pattern, so it needn't be watched or
+// walked. An exception could let something in it through, so with any,
+// only rel itself counts.
+func ignoredDir(rel string) bool {
+	if ignored(rel) {
+		return true
+	}
+
+	for _, p := range ignorePatterns {
+		if strings.HasPrefix(p, "!") {
+			return false
+		}
+	}
+
+	match, err := ignore.Matches(filepath.Join(rel, "**"), ignorePatterns)
+
+	return err == nil && match
+}
+
+func run() (err error) {
+	var synced bool
+
+	defer func() {
+		if err != nil && !synced {
+			notify("initial sync failed: %s", err)
+		}
+	}()
+
+	switch *fPLim {
+	case "skip", "fail", "off":
+	default:
+		return errors.Errorf("unknown -path-limits: %s", *fPLim)
+	}
+
+	if err = useLongPaths(); err != nil {
+		return err
+	}
+
 	statusPath := filepath.Join(*fDest, ".synced")
 
-	os.Remove(statusPath)
+	// With -atomic-dest the live tree stays intact until the swap.
+	if !*fAtom {
+		os.Remove(statusPath)
+	}
+
+	if err = checkDestAccess(); err != nil {
+		return err
+	}
+
+	if *fComp && !*fAtom {
+		compressTree(*fDest)
+	}
 
-	w, err := fsnotify.NewWatcher()
+	if *fPrbe {
+		if err = probeDest(); err != nil {
+			return err
+		}
+	}
+
+	var unapplied []string
+
+	if *fJrnl != "" {
+		if unapplied, err = openJournal(*fJrnl); err != nil {
+			return err
+		}
+	}
+
+	w, err := newWatcher()
 	if err != nil {
 		return err
 	}
 
-	defer w.Close()
+	// The watchdog can replace w.
+	defer func() { w.Close() }()
+
+	fi, err := os.Stat(*fSrc)
+	if err != nil {
+		return err
+	}
 
-	err = w.Add(*fSrc)
+	err = watchDir(w, *fSrc, fi)
 	if err != nil {
 		return err
 	}
 
 	cancel := make(chan os.Signal, 1)
 
-	signal.Notify(cancel, os.Interrupt)
+	notifyInterrupt(cancel)
+
+	if *fCtrl {
+		go readControl(cancel)
+	}
+
+	if *fGWat {
+		log.Printf("Waiting for StartSync")
+		state.setPhase("waiting")
+
+		select {
+		case <-control.start:
+		case <-cancel:
+			return nil
+		}
+	}
+
+	if !waitUnpaused(cancel) {
+		return nil
+	}
+
+	if *fPLim == "fail" {
+		if err = checkPathLimits(cancel); err != nil {
+			return err
+		}
+	}
+
+	if *fWarm != "" {
+		if err = loadFingerprints(); err != nil {
+			return err
+		}
+	}
+
+	initial := func(w watcher, r syncRoots) error {
+		if *fAtom {
+			return atomicSyncDirs(w, cancel, r, filepath.Join(*fDest+".new", ".synced"))
+		}
+
+		return syncDirs(w, cancel, r)
+	}
+
+	if *fSnap != "" {
+		err = fromSnapshot(w, cancel, initial)
+	} else {
+		err = initial(w, liveRoots())
+	}
 
-	err = syncDirs(w, cancel)
 	if err != nil {
 		return err
 	}
 
-	// Touch the status path to tell others it's ready
-	f, err := os.Create(statusPath)
-	if err == nil {
-		f.Close()
+	replayJournal(unapplied, w)
+
+	if err = saveFingerprints(); err != nil {
+		return err
+	}
+
+	// With -atomic-dest, .synced was made in the staging tree.
+	readiness.ready = *fAtom
+	ready := checkReady(statusPath)
+
+	publish(syncEvent{Kind: eventInitialSyncDone})
+	synced = true
+
+	if *fWMan != "" {
+		if err = writeManifest(cancel); err != nil {
+			return err
+		}
+	}
+
+	var configEvents <-chan fsnotify.Event
+
+	if *fConf != "" {
+		cw, err := watchConfig()
+		if err != nil {
+			return err
+		}
+
+		defer cw.Close()
+
+		configEvents = cw.Events
+	}
+
+	var linkEvents <-chan fsnotify.Event
+
+	if srcLink != "" {
+		lw, err := watchSrcLink()
+		if err != nil {
+			return err
+		}
+
+		defer lw.Close()
+
+		linkEvents = lw.Events
 	}
 
 	log.Printf("Watching for events")
+	state.setPhase("watching")
+
+	queue := newEventQueue(*fQueu)
+	state.setQueue(queue)
+
+	stopPump := queue.pump(w)
+	defer func() { stopPump() }()
+
+	var (
+		pending   = newBatch()
+		timer     = time.NewTimer(time.Hour)
+		chmods    = make(map[string]bool)
+		chmodTime = time.NewTimer(time.Hour)
+		mv        = make(moves)
+		moveTimer = time.NewTimer(time.Hour)
+		retry     = time.NewTicker(deferCheck)
+		rescans   <-chan time.Time
+		dog       watchdog
+		paused    bool
+	)
+
+	defer retry.Stop()
+
+	if *fRscn > 0 {
+		t := time.NewTicker(*fRscn)
+		defer t.Stop()
+
+		rescans = t.C
+	}
+
+	timer.Stop()
+	moveTimer.Stop()
+	chmodTime.Stop()
+
+	// checkPause pauses or resumes as the pause file says, applying what
+	// was held on resuming.
+	checkPause := func() {
+		now := pauseRequested()
+
+		switch {
+		case now && !paused:
+			log.Printf("Paused until %s is removed", *fPaus)
+			state.setPhase("paused")
+		case !now && paused:
+			log.Printf("Resuming, applying %d held changes", len(pending.ops))
+			state.setPhase("watching")
+
+			if len(pending.ops) > 0 {
+				timer.Reset(0)
+			}
+
+			// Directories made while paused weren't watched, so what's in
+			// them went unseen.
+			for rel := range pending.ops {
+				if fi, err := os.Lstat(filepath.Join(*fSrc, rel)); err == nil && fi.IsDir() {
+					queue.markDirty(filepath.Join(*fSrc, rel))
+				}
+			}
+		}
+
+		paused = now
+	}
 
 	for {
 		select {
 		case <-cancel:
-			return nil
-		case err := <-w.Errors:
-			return err
-		case ev := <-w.Events:
-			rel, err := filepath.Rel(*fSrc, ev.Name)
+			// Writing what's held would defeat the pause.
+			if paused || !*fVrfy && *fWMan == "" {
+				return nil
+			}
+
+			// Apply anything still waiting so it isn't reported as drift.
+			if len(pending.ops) > 0 {
+				paths := pending.paths()
+
+				if err = applyBatch(pending, w, statusPath); err != nil {
+					return err
+				}
+
+				journal.done(paths...)
+			}
+
+			mv.flush(w)
+
+			if *fWMan != "" {
+				if err = writeManifest(cancel); err != nil {
+					return err
+				}
+			}
+
+			if !*fVrfy {
+				return nil
+			}
+
+			return verifyDest(cancel)
+		case err := <-w.Errors():
+			// The kernel dropping events is no fault of the watcher, a
+			// rescan picks up what they were for.
+			if err == fsnotify.ErrEventOverflow {
+				log.Printf("Watcher queue overflowed, rescanning %s", *fSrc)
+				queue.markDirty(*fSrc)
+				continue
+			}
+
+			stopPump()
+
+			nw, err := dog.restart(w, err, cancel)
 			if err != nil {
+				notify("watcher died: %s", err)
 				return err
 			}
 
-			if match, err := ignore.Matches(rel, ignorePatterns); err == nil && match {
-				return nil
+			w = nw
+			stopPump = queue.pump(w)
+		case ev := <-queue.c:
+			// Events left over from before -src was retargeted are outside
+			// the source now.
+			rel, err := filepath.Rel(*fSrc, ev.Name)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+				continue
 			}
 
-			if ev.Op&fsnotify.Create == fsnotify.Create {
-				if err = createEntry(rel, w); err != nil {
-					return err
+			if isPauseFile(rel) {
+				checkPause()
+				continue
+			}
+
+			if ignored(rel) {
+				continue
+			}
+
+			if *fNoCh {
+				ev.Op &^= fsnotify.Chmod
+
+				if ev.Op == 0 {
+					continue
 				}
 			}
 
-			if ev.Op&fsnotify.Write == fsnotify.Write {
-				if err = copyFile(rel, true); err != nil {
-					return err
+			journal.accept(rel)
+
+			// The batch is held while paused.
+			if paused {
+				pending.add(rel, ev.Op)
+				state.setQueued(len(pending.ops))
+				continue
+			}
+
+			if *fDbnc == 0 {
+				if ev.Op == fsnotify.Chmod {
+					if len(chmods) == 0 {
+						chmodTime.Reset(chmodWait)
+					}
+
+					chmods[rel] = true
+					state.setQueued(len(chmods))
+					continue
+				}
+
+				if ev.Op&fsnotify.Rename == fsnotify.Rename && mv.renamed(rel) {
+					moveTimer.Reset(moveWait)
+					continue
 				}
+
+				if ev.Op&fsnotify.Create == fsnotify.Create {
+					if old, ok := mv.created(rel); ok {
+						moveOrCopy(withOp(context.Background()), old, rel, w)
+						journal.done(old, rel)
+
+						continue
+					}
+				}
+
+				ctx := withOp(context.Background())
+
+				if err = handleEvent(ctx, ev, rel, w); err != nil {
+					recordFailure(ctx, rel, err)
+				} else {
+					clearFailure(rel)
+					journal.done(rel)
+				}
+
+				continue
+			}
+
+			pending.add(rel, ev.Op)
+			state.setQueued(len(pending.ops))
+			timer.Reset(*fDbnc)
+		case ev := <-configEvents:
+			if isConfigEvent(ev) {
+				reloadConfig()
 			}
+		case ev := <-linkEvents:
+			if isSrcLinkEvent(ev) {
+				stopPump()
+
+				nw, err := followSrcLink(w, cancel)
+				if nw != nil {
+					w = nw
+				}
 
-			if ev.Op&fsnotify.Remove == fsnotify.Remove {
-				if err = removeEntry(rel, w); err != nil {
+				stopPump = queue.pump(w)
+
+				if err != nil {
 					return err
 				}
 			}
+		case <-retry.C:
+			journal.sync()
+
+			// In case the pause file's event was lost to an overflow.
+			if checkPause(); paused {
+				continue
+			}
+
+			retryDeferred()
+			retryFailed(w)
 
-			if ev.Op&fsnotify.Chmod == fsnotify.Chmod {
-				if err = chmodFile(rel); err != nil {
+			if !ready {
+				ready = checkReady(statusPath)
+			}
+
+			if dirty := queue.takeDirty(); len(dirty) > 0 {
+				if err = rescanDirty(w, cancel, dirty); err != nil {
 					return err
 				}
 			}
+		case <-rescans:
+			if paused {
+				continue
+			}
+
+			if err = rescan(w, cancel, true); err != nil {
+				return err
+			}
+		case done := <-control.rescans:
+			if paused {
+				done <- errors.Errorf("paused until %s is removed", *fPaus)
+				continue
+			}
+
+			done <- rescan(w, cancel, false)
+		case <-moveTimer.C:
+			mv.flush(w)
+		case <-chmodTime.C:
+			for rel := range chmods {
+				ev := fsnotify.Event{Name: filepath.Join(*fSrc, rel), Op: fsnotify.Chmod}
+				ctx := withOp(context.Background())
+
+				if err = handleEvent(ctx, ev, rel, w); err != nil {
+					recordFailure(ctx, rel, err)
+				} else {
+					clearFailure(rel)
+					journal.done(rel)
+				}
+			}
+
+			chmods = make(map[string]bool)
+			state.setQueued(0)
+		case <-timer.C:
+			if paused {
+				continue
+			}
+
+			paths := pending.paths()
+
+			// Paths that fail are retried on their own, so all that's
+			// left to fail the batch is the status file.
+			if err := applyBatch(pending, w, statusPath); err != nil {
+				log.Printf("Error applying batch: %s", err)
+			}
+
+			journal.done(paths...)
+			runExec(paths)
+
+			pending = newBatch()
+			state.setQueued(0)
+		}
+	}
+}
+
+// handleEvent applies the event ev for rel, as the operation of ctx.
+func handleEvent(ctx context.Context, ev fsnotify.Event, rel string, w watcher) (err error) {
+	ctx, span := tracer.Start(ctx, "sync.event",
+		trace.WithAttributes(
+			attribute.String("sync.path", rel),
+			attribute.String("sync.op", ev.Op.String()),
+			attribute.Int64("sync.op_id", int64(opOf(ctx))),
+		))
+
+	defer func() {
+		if err != nil {
+			publish(syncEvent{Kind: eventErrored, Path: rel, Error: err.Error(), Op: opOf(ctx)})
+		}
+
+		endSpan(span, err)
+	}()
+
+	state.begin(ev.Op.String(), rel)
+	defer state.end()
+
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		if err = createEntry(ctx, rel, w); err != nil {
+			return err
 		}
 	}
+
+	if ev.Op&fsnotify.Write == fsnotify.Write {
+		if err = copyFile(ctx, rel, true); err != nil {
+			return err
+		}
+	}
+
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if err = removeEntry(rel, w); err != nil {
+			return err
+		}
+	}
+
+	if ev.Op&fsnotify.Chmod == fsnotify.Chmod {
+		if err = syncMetadata(ctx, rel); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func setupLink(to, from string) error {
@@ -122,6 +837,10 @@ func setupLink(to, from string) error {
 		return errors.Wrapf(err, "reading link from %s", from)
 	}
 
+	if !destFeatures.symlinks {
+		return copyLinkTarget(to, from)
+	}
+
 	os.Remove(to)
 
 	err = os.Symlink(lnk, to)
@@ -132,125 +851,334 @@ func setupLink(to, from string) error {
 	return nil
 }
 
-func syncDirs(w *fsnotify.Watcher, cancel chan os.Signal) error {
+// walkSource walks the source tree, calling fn for every entry that isn't
+// ignored. Ignored directories are skipped entirely. The walk stops with an
+// error if cancel fires.
+func walkSource(cancel chan os.Signal, fn func(path, rel string, fi os.FileInfo) error) error {
+	return walkTree(*fSrc, cancel, fn)
+}
+
+// walkTree is walkSource for the subtree of the source at root.
+func walkTree(root string, cancel chan os.Signal, fn func(path, rel string, fi os.FileInfo) error) error {
+	return walkFrom(*fSrc, root, cancel, fn)
+}
+
+// walkFrom is walkTree for the subtree at root of the source tree src.
+func walkFrom(src, root string, cancel chan os.Signal, fn func(path, rel string, fi os.FileInfo) error) error {
+	return streamWalk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-cancel:
+			return fmt.Errorf("canceled")
+		default:
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrapf(err, "calculating rel path")
+		}
+
+		if fi.IsDir() && rel != "." && ignoredDir(rel) {
+			return filepath.SkipDir
+		}
+
+		if ignored(rel) {
+			return nil
+		}
+
+		return fn(path, rel, fi)
+	})
+}
+
+// progress logs every 100th directory visited during a walk.
+type progress struct {
+	n int
+}
+
+func (p *progress) dir(path string) {
+	if p.n == 0 {
+		log.Printf("=> %s", path)
+	}
+
+	p.n++
+	if p.n == 100 {
+		p.n = 0
+	}
+}
+
+// syncDirs performs the initial sync from r's source to its destination.
+func syncDirs(w watcher, cancel chan os.Signal, r syncRoots) (err error) {
 	log.Printf("Performing initial sync")
+	state.setPhase("initial sync")
+
+	ctx, span := tracer.Start(context.Background(), "sync.initial",
+		trace.WithAttributes(attribute.String("sync.src", r.src), attribute.String("sync.dest", r.dest)))
+	defer func() {
+		if err != nil {
+			publishError("", err)
+		}
+
+		endSpan(span, err)
+	}()
+
+	// Once priority paths are synced the destination isn't empty, so the
+	// rest goes file by file rather than via tar.
+	first, err := syncPriority(ctx, w, cancel, r)
+	if err != nil {
+		return err
+	}
+
+	if *fTar && tarUsable() {
+		empty, err := dirEmpty(r.dest)
+		if err != nil {
+			return errors.Wrapf(err, "checking destination")
+		}
+
+		if empty {
+			return tarSyncDirs(ctx, w, cancel, r)
+		}
+	}
+
+	total, err := syncTree(ctx, w, cancel, r, false, func(rel string, err error) error {
+		return err
+	})
+
+	total += first
+
+	span.SetAttributes(attribute.Int64("sync.bytes", total))
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Initial sync done: %d bytes", total)
+
+	return nil
+}
+
+// rescan walks the whole source again, fixing up anything in the
+// destination that drifted and removing what's gone from the source.
+// Paths that fail are retried like failed events, and the dead letters
+// get another chance. With changedOnly, -rescan-changed applies.
+func rescan(w watcher, cancel chan os.Signal, changedOnly bool) (err error) {
+	log.Printf("Rescanning %s", *fSrc)
+	state.setPhase("rescan")
+	defer state.setPhase("watching")
+
+	ctx, span := tracer.Start(context.Background(), "sync.rescan",
+		trace.WithAttributes(attribute.String("sync.src", *fSrc), attribute.String("sync.dest", *fDest)))
+	defer func() { endSpan(span, err) }()
+
+	reviveDead()
+
+	onErr := func(rel string, err error) error {
+		publishError(rel, err)
+		recordFailure(context.Background(), rel, err)
+		return nil
+	}
+
+	diff := changedOnly && *fRDif
 
 	var total int64
-	var nprint int
+	if diff {
+		total, err = syncChanged(ctx, w, cancel, onErr)
+	} else {
+		dirPrints = nil
+		total, err = syncTree(ctx, w, cancel, liveRoots(), false, onErr)
+	}
+
+	span.SetAttributes(attribute.Int64("sync.bytes", total))
+
+	if err != nil {
+		return err
+	}
+
+	// An upperdir only has what changed, so the rest of the destination
+	// isn't stale.
+	if !*fOvly && !diff {
+		if err = pruneDest("."); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rescan done: %d bytes", total)
+
+	return nil
+}
+
+// syncTree copies everything in r's source that differs from its
+// destination, returning the bytes copied. With exact, only files with
+// the same size and mtime are taken to be the same, not ones that are
+// merely newer in the destination. Each path that fails is passed to
+// onErr, which decides whether to carry on.
+func syncTree(ctx context.Context, w watcher, cancel chan os.Signal, r syncRoots, exact bool, onErr func(rel string, err error) error) (int64, error) {
+	t := &treeSync{w: w, roots: r, dirs: newDirSpans(ctx), exact: exact, pool: newCopyPool(r, onErr)}
+
+	err := walkFrom(r.src, r.src, cancel, func(path, rel string, fi os.FileInfo) error {
+		if err := t.visit(path, rel, fi); err != nil {
+			return onErr(rel, err)
+		}
+
+		return nil
+	})
+
+	if t.pool != nil {
+		if perr := t.pool.wait(err != nil); err == nil {
+			err = perr
+		}
+	}
+
+	t.dirs.close()
+
+	return t.total, err
+}
+
+// treeSync is the state of a syncTree walk.
+type treeSync struct {
+	w     watcher
+	roots syncRoots
+	dirs  *dirSpans
+	exact bool
+	pool  *copyPool
+	prog  progress
+	total int64
+}
+
+// visit syncs a single entry of the source and its owner.
+func (t *treeSync) visit(path, rel string, fi os.FileInfo) error {
+	if err := t.entry(path, rel, fi); err != nil {
+		return err
+	}
+
+	to := t.roots.to(rel)
+	if fi.IsDir() {
+		to = t.roots.toDir(rel)
+	}
+
+	return syncOwner(path, to, fi)
+}
+
+// entry syncs a single entry of the source.
+func (t *treeSync) entry(path, rel string, fi os.FileInfo) error {
+	to := t.roots.to(rel)
+
+	state.begin("walk", rel)
+	defer state.end()
+
+	if fi.IsDir() {
+		t.dirs.push(path, rel)
+		t.prog.dir(path)
 
-	err := filepath.Walk(*fSrc, func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
+		if *fOvly && isOpaque(path) {
+			if err := clearOpaque(t.roots, rel); err != nil {
+				return err
+			}
 		}
 
-		select {
-		case <-cancel:
-			return fmt.Errorf("canceled")
-		default:
+		watchDir(t.w, path, fi)
+
+		to = t.roots.toDir(rel)
+		if err := mkdirParents(t.roots, rel); err != nil {
+			return err
 		}
 
-		rel, err := filepath.Rel(*fSrc, path)
+		ft, err := os.Lstat(to)
 		if err != nil {
-			return errors.Wrapf(err, "calculating rel path")
-		}
+			if os.IsNotExist(err) {
+				err = os.Mkdir(to, fi.Mode())
+				if err != nil {
+					return errors.Wrapf(err, "making a directory")
+				}
 
-		if match, err := ignore.Matches(rel, ignorePatterns); err == nil && match {
-			if fi.IsDir() {
-				return filepath.SkipDir
+				return nil
 			}
-
-			return nil
+			return errors.Wrapf(err, "error stating")
 		}
 
-		to := filepath.Join(*fDest, rel)
-
-		if fi.IsDir() {
-			if nprint == 0 {
-				log.Printf("=> %s", path)
-				nprint++
-			} else {
-				nprint++
-				if nprint == 100 {
-					nprint = 0
-				}
+		if !ft.IsDir() {
+			err = os.Remove(to)
+			if err != nil {
+				return errors.Wrapf(err, "removing errant non-dir")
 			}
 
-			w.Add(path)
-			ft, err := os.Lstat(to)
+			err = os.Mkdir(to, fi.Mode())
 			if err != nil {
-				if os.IsNotExist(err) {
-					err = os.Mkdir(to, fi.Mode())
-					if err != nil {
-						return errors.Wrapf(err, "making a directory")
-					}
-
-					return nil
-				}
-				return errors.Wrapf(err, "error stating")
+				return errors.Wrapf(err, "making a directory")
 			}
-
-			if !ft.IsDir() {
-				err = os.Remove(to)
-				if err != nil {
-					return errors.Wrapf(err, "removing errant non-dir")
-				}
-
-				err = os.Mkdir(to, fi.Mode())
-				if err != nil {
-					return errors.Wrapf(err, "making a directory")
-				}
-			} else {
-				err = os.Chmod(to, fi.Mode())
-				if err != nil {
-					return errors.Wrapf(err, "chmod")
-				}
+		} else {
+			err = os.Chmod(to, fi.Mode())
+			if err != nil {
+				return errors.Wrapf(err, "chmod")
 			}
+		}
 
-			return nil
+		return nil
+	}
+
+	if !fi.Mode().IsRegular() {
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return setupLink(to, path)
 		}
 
-		if !fi.Mode().IsRegular() {
-			if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-				return setupLink(to, path)
-			}
+		if *fOvly && isWhiteout(fi) {
+			return applyWhiteout(t.roots, rel)
+		}
 
-			return nil
+		if *fFake {
+			return standIn(to)
 		}
 
-		if tfi, err := os.Lstat(to); err == nil {
-			// We're expending a regular file and ergo if the dest is not a regular file, remove it.
-			if !tfi.Mode().IsRegular() {
-				err = os.RemoveAll(to)
-				if err != nil {
-					return err
-				}
-			} else if tfi.Size() == fi.Size() && tfi.ModTime().After(fi.ModTime()) || tfi.ModTime().Equal(fi.ModTime()) {
+		return nil
+	}
+
+	if tfi, err := os.Lstat(to); err == nil {
+		// We're expending a regular file and ergo if the dest is not a regular file, remove it.
+		if !tfi.Mode().IsRegular() {
+			err = os.RemoveAll(to)
+			if err != nil {
+				return err
+			}
+		} else if inodeChanged(rel, fi) {
+			// Replaced by a rename, so the content is new whatever the
+			// size and mtime say.
+		} else if transformsFor(rel) != nil {
+			if transformedSame(rel, to, fi, tfi) {
+				return nil
+			}
+		} else if t.exact {
+			if tfi.Size() == fi.Size() && sameMtime(tfi.ModTime(), fi.ModTime()) {
 				return nil
 			}
+		} else if tfi.Size() == fi.Size() && (tfi.ModTime().After(fi.ModTime()) || sameMtime(tfi.ModTime(), fi.ModTime())) {
+			return nil
 		}
 
-		total += fi.Size()
-		err = copyFile(rel, false)
-		if err != nil {
-			return errors.Wrapf(err, "copying file")
+		if tfi.Mode().IsRegular() && warmMatch(rel, path, to, fi, tfi) {
+			return nil
 		}
+	}
 
-		return nil
-	})
+	t.total += fi.Size()
 
-	if err != nil {
-		return err
+	if t.pool != nil {
+		return t.pool.copy(t.dirs.enter(path), rel)
 	}
 
-	log.Printf("Initial sync done: %d bytes", total)
+	err := copyFileFrom(t.dirs.enter(path), t.roots, rel, to, false)
+	if err != nil {
+		return errors.Wrapf(err, "copying file")
+	}
 
 	return nil
 }
 
-func createEntry(rel string, w *fsnotify.Watcher) error {
+func createEntry(ctx context.Context, rel string, w watcher) error {
 	var (
 		from = filepath.Join(*fSrc, rel)
-		to   = filepath.Join(*fDest, rel)
+		to   = destPath(rel)
 	)
 
 	fi, err := os.Lstat(from)
@@ -258,22 +1186,61 @@ func createEntry(rel string, w *fsnotify.Watcher) error {
 		return err
 	}
 
+	// Paths reach here from retries and batches as well as events, so
+	// check again before anything is copied or watched.
+	if ignored(rel) || fi.IsDir() && ignoredDir(rel) {
+		return nil
+	}
+
 	if fi.IsDir() {
-		log.Printf("Created directory %s", rel)
+		opLogf(ctx, "Created directory %s", rel)
+
+		// A directory replacing one from the lower layers is opaque, and
+		// the lower one is in the destination already.
+		opaque := *fOvly && isOpaque(from)
+		if opaque {
+			if err := clearOpaque(liveRoots(), rel); err != nil {
+				return err
+			}
+		}
+
+		// Directories flattened by -map share where they go.
+		to = destDir(rel)
+		shared := to != destPath(rel)
+
+		if err := mkdirParents(liveRoots(), rel); err != nil {
+			return err
+		}
 
 		err := os.Mkdir(to, fi.Mode())
-		if err != nil {
+		if err != nil && !((opaque || shared) && os.IsExist(err)) {
 			return err
 		}
 
-		w.Add(from)
+		watchDir(w, from, fi)
 
-		return nil
+		return syncOwner(from, to, fi)
 	}
 
 	if !fi.Mode().IsRegular() {
 		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-			return setupLink(to, from)
+			if err = setupLink(to, from); err != nil {
+				return err
+			}
+
+			return syncOwner(from, to, fi)
+		}
+
+		if *fOvly && isWhiteout(fi) {
+			return applyWhiteout(liveRoots(), rel)
+		}
+
+		if *fFake {
+			if err = standIn(to); err != nil {
+				return err
+			}
+
+			return syncOwner(from, to, fi)
 		}
 
 		// skip non-regular files entirely
@@ -287,31 +1254,66 @@ func createEntry(rel string, w *fsnotify.Watcher) error {
 			if err != nil {
 				return err
 			}
-		} else if tfi.Size() == fi.Size() && tfi.ModTime().After(fi.ModTime()) || tfi.ModTime().Equal(fi.ModTime()) {
+		} else if inodeChanged(rel, fi) {
+			// Replaced by a rename, so the content is new.
+		} else if transformsFor(rel) != nil {
+			if transformedSame(rel, to, fi, tfi) {
+				return nil
+			}
+		} else if tfi.Size() == fi.Size() && (tfi.ModTime().After(fi.ModTime()) || sameMtime(tfi.ModTime(), fi.ModTime())) {
 			return nil
 		}
 	}
 
+	// A file moved into the tree arrives complete, with no writes to
+	// follow.
+	if fi.Size() > 0 || *fEmpt {
+		return copyFile(ctx, rel, true)
+	}
+
 	f, err := os.OpenFile(to, os.O_CREATE, fi.Mode())
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Created file %s", rel)
-	return f.Close()
+	opLogf(ctx, "Created file %s", rel)
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return syncOwner(from, to, fi)
 }
 
-func copyFile(rel string, stat bool) error {
-	var (
-		from = filepath.Join(*fSrc, rel)
-		to   = filepath.Join(*fDest, rel)
-	)
+func copyFile(ctx context.Context, rel string, stat bool) error {
+	return copyFileTo(ctx, rel, destPath(rel), stat)
+}
+
+// copyFileTo copies the source file at rel to the path to.
+func copyFileTo(ctx context.Context, rel, to string, stat bool) error {
+	return copyFileFrom(ctx, liveRoots(), rel, to, stat)
+}
+
+// copyFileFrom is copyFileTo from r's source, with the blobs of -cas in
+// r's destination.
+func copyFileFrom(ctx context.Context, roots syncRoots, rel, to string, stat bool) (err error) {
+	from := roots.from(rel)
+
+	ctx = withOp(ctx)
+
+	_, span := tracer.Start(ctx, "sync.copy", trace.WithAttributes(
+		attribute.String("sync.path", rel),
+		attribute.Int64("sync.op_id", int64(opOf(ctx))),
+	))
+	defer func() { endSpan(span, err) }()
 
 	ff, err := os.Open(from)
 	if err != nil {
 		return err
 	}
 
+	defer ff.Close()
+
 	fi, err := ff.Stat()
 	if err != nil {
 		return err
@@ -319,75 +1321,269 @@ func copyFile(rel string, stat bool) error {
 
 	switch fi.Mode() & os.ModeType {
 	case os.ModeDevice, os.ModeCharDevice:
-		log.Printf("Cowardly refusing to copy devices")
+		opLogf(ctx, "Cowardly refusing to copy devices")
 		return nil
 	case os.ModeNamedPipe:
-		log.Printf("Cowardly refusing to copy named pipe")
+		opLogf(ctx, "Cowardly refusing to copy named pipe")
 		return nil
 	case os.ModeSocket:
-		log.Printf("Cowardly refusing to copy socket")
+		opLogf(ctx, "Cowardly refusing to copy socket")
 		return nil
 	case os.ModeDir:
-		log.Printf("Cowardly refusing to copy directory")
+		opLogf(ctx, "Cowardly refusing to copy directory")
 		return nil
 	case os.ModeSymlink, 0:
 		// symlink or regular, that's fine
 	default:
-		log.Printf("Cowardly refusing to copy unknown file type: %d", fi.Mode()&os.ModeType)
+		opLogf(ctx, "Cowardly refusing to copy unknown file type: %d", fi.Mode()&os.ModeType)
+		return nil
+	}
+
+	if *fDefr && openForWriting(rel) {
+		deferCopy(rel, "open for writing")
+		return nil
+	}
+
+	strategy := strategyFor(rel)
+
+	// Files copied with skip-hot wait to settle whatever their size.
+	settle := *fSetl > 0 && fi.Size() >= *fSetl || isSettling(rel) || strategy == "skip-hot"
+
+	if settle && !settled(rel, fi) {
+		deferCopy(rel, "waiting for it to stop growing")
+		return nil
+	}
+
+	if strategy == "skip-hot" && openForWriting(rel) {
+		deferCopy(rel, "waiting for it to be closed")
+		return nil
+	}
+
+	if err = chaosCopy(rel); err != nil {
+		return err
+	}
+
+	src := &countedReader{r: ff}
+
+	var r io.Reader = limitRead(src)
+
+	if ts := transformsFor(rel); ts != nil {
+		r, err = transformReader(rel, r, ts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *fCAS {
+		if stat {
+			opLogf(ctx, "Storing %s (%d bytes)", rel, fi.Size())
+		}
+
+		blob, n, err := storeBlob(roots.blobs(), r, fi.Mode())
+		if err != nil {
+			return err
+		}
+
+		span.SetAttributes(attribute.Int64("sync.bytes", n))
+
+		// The blob is whole, if not what's wanted, so it's just not linked.
+		if why, gone := sourceChanged(ff, from, fi, src.n); why != "" {
+			if !gone {
+				retryChanged(ctx, rel, why)
+			}
+
+			return nil
+		}
+
+		if err = linkBlob(blob, to); err != nil {
+			return err
+		}
+
+		noteInode(rel, fi)
+		publish(syncEvent{Kind: eventCopied, Path: rel, Bytes: n, Op: opOf(ctx)})
+
 		return nil
 	}
 
+	if *fVWri && fi.Size() > 0 {
+		if stat {
+			opLogf(ctx, "Copying %s (%d bytes), verifying", rel, fi.Size())
+		}
+
+		n, err := verifiedCopy(ctx, rel, from, to, fi)
+		if err != nil {
+			return err
+		}
+
+		span.SetAttributes(attribute.Int64("sync.bytes", n))
+
+		return finishCopy(ctx, rel, from, to, fi, n)
+	}
+
+	// Transformed content can't be appended to, as it's transformed whole.
+	if strategy == "append" && transformsFor(rel) == nil {
+		start, n, ok, err := appendCopy(ff, to, fi)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if stat {
+				opLogf(ctx, "Appended %d bytes to %s", n, rel)
+			}
+
+			span.SetAttributes(attribute.Int64("sync.bytes", n))
+
+			if why, _ := sourceChanged(ff, from, fi, start+n); why != "" {
+				retryChanged(ctx, rel, why)
+				return nil
+			}
+
+			return finishCopy(ctx, rel, from, to, fi, n)
+		}
+	}
+
 	tf, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Printf("Unable to copy to %s, doesn't exist", rel)
+			opLogf(ctx, "Unable to copy to %s, doesn't exist", rel)
 			return nil
 		}
 
 		return errors.Wrapf(err, "opening file for writing")
 	}
 
+	compressFile(tf)
+
 	// Skip where the from is size 0, ie a lock file
 	if fi.Size() == 0 {
-		log.Printf("File %s is 0 bytes, truncating", rel)
-		return tf.Close()
+		opLogf(ctx, "File %s is 0 bytes, truncating", rel)
+
+		if err = tf.Close(); err != nil {
+			return err
+		}
+
+		if *fEmpt {
+			if err = os.Chmod(to, fi.Mode()); err != nil {
+				return err
+			}
+
+			if err = os.Chtimes(to, fi.ModTime(), fi.ModTime()); err != nil {
+				return err
+			}
+
+			if err = syncOwner(from, to, fi); err != nil {
+				return err
+			}
+		}
+
+		noteInode(rel, fi)
+		publish(syncEvent{Kind: eventCopied, Path: rel, Op: opOf(ctx)})
+
+		return nil
 	}
 
 	if stat {
-		log.Printf("Copying %s (%d bytes)", rel, fi.Size())
+		opLogf(ctx, "Copying %s (%d bytes)", rel, fi.Size())
 	}
 
 	start := time.Now()
 
-	_, err = io.Copy(tf, ff)
+	sw, finish := sparseWriter(tf, fi)
+
+	n, err := copyData(limitWrite(chaosWriter(sw)), r, fi.Size())
+	if err == nil {
+		err = finish()
+	}
+
 	if err != nil {
+		tf.Close()
 		return err
 	}
 
+	span.SetAttributes(
+		attribute.Int64("sync.bytes", n),
+		attribute.Float64("sync.duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+	)
+
 	if stat {
-		log.Printf(" Copied %s (%s elapsed)", rel, time.Since(start))
+		opLogf(ctx, " Copied %s (%s elapsed)", rel, time.Since(start))
+	}
+
+	if err = tf.Close(); err != nil {
+		return err
+	}
+
+	// Rather than leave a short file, remove it, and copy the source again
+	// unless it's gone too.
+	if why, gone := sourceChanged(ff, from, fi, src.n); why != "" {
+		if err = os.Remove(to); err != nil {
+			return errors.Wrapf(err, "removing partial copy of %s", rel)
+		}
+
+		if gone {
+			opLogf(ctx, "Source %s %s while being copied, removed the partial copy", rel, why)
+		} else {
+			retryChanged(ctx, rel, why)
+		}
+
+		return nil
 	}
 
+	return finishCopy(ctx, rel, from, to, fi, n)
+}
+
+// finishCopy carries fi's metadata over to a freshly copied file.
+func finishCopy(ctx context.Context, rel, from, to string, fi os.FileInfo, n int64) error {
+	// Carry the mtime over so later metadata changes and restarts can
+	// compare against it.
+	if err := os.Chtimes(to, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+
+	// Blobs are shared, so files stored with -cas keep the blob's owner.
+	if err := syncOwner(from, to, fi); err != nil {
+		return err
+	}
+
+	if transformsFor(rel) != nil {
+		noteTransformed(rel, to, fi)
+	}
+
+	noteInode(rel, fi)
+	publish(syncEvent{Kind: eventCopied, Path: rel, Bytes: n, Op: opOf(ctx)})
+
 	return nil
 }
 
-func removeEntry(rel string, w *fsnotify.Watcher) error {
+func removeEntry(rel string, w watcher) error {
 	var (
 		from = filepath.Join(*fSrc, rel)
-		to   = filepath.Join(*fDest, rel)
+		to   = destPath(rel)
 	)
 
+	unwatchDirs(w, rel)
 	w.Remove(from)
+	forgetInode(rel)
 
 	log.Printf("Remove %s", rel)
-	os.Remove(to)
+
+	// Files the source ignores can be left holding up a directory.
+	if os.Remove(to) != nil && stPatterns != nil {
+		clearDeletable(rel)
+		os.Remove(to)
+	}
+
+	publish(syncEvent{Kind: eventRemoved, Path: rel})
 	return nil
 }
 
-func chmodFile(rel string) error {
+// syncMetadata applies mode and mtime changes, such as from chmod or touch,
+// to the destination without reading any content.
+func syncMetadata(ctx context.Context, rel string) error {
 	var (
 		from = filepath.Join(*fSrc, rel)
-		to   = filepath.Join(*fDest, rel)
+		to   = destPath(rel)
 	)
 
 	fi, err := os.Lstat(from)
@@ -395,7 +1591,59 @@ func chmodFile(rel string) error {
 		return err
 	}
 
-	log.Printf("Chmod %s (%s)", rel, fi.Mode())
+	tfi, err := os.Lstat(to)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err = syncOwner(from, to, fi); err != nil {
+		return err
+	}
+
+	// Chmod would follow the link, and the link itself has no mode.
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return nil
+	}
+
+	if tfi.Mode() != fi.Mode() {
+		opLogf(ctx, "Chmod %s (%s)", rel, fi.Mode())
+
+		// A blob's mode is shared by every link to it, so link to a blob
+		// with the new mode instead.
+		if *fCAS && fi.Mode().IsRegular() {
+			return copyFile(ctx, rel, false)
+		}
+
+		if err = os.Chmod(to, fi.Mode()); err != nil {
+			return err
+		}
+
+		publish(syncEvent{Kind: eventChmodded, Path: rel})
+	}
+
+	// Only regular files with content in sync get their mtime, a size
+	// mismatch means a write is on its way to do the copy. Blobs share
+	// their mtime across links, so leave it be.
+	if !fi.Mode().IsRegular() || *fCAS || sameMtime(tfi.ModTime(), fi.ModTime()) {
+		return nil
+	}
+
+	// Transformed content can legitimately differ in size.
+	if tfi.Size() != fi.Size() && transformsFor(rel) == nil {
+		return nil
+	}
+
+	opLogf(ctx, "Touch %s (%s)", rel, fi.ModTime())
+
+	if err = os.Chtimes(to, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+
+	publish(syncEvent{Kind: eventChmodded, Path: rel})
 
-	return os.Chmod(to, fi.Mode())
+	return nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// moveWait is how long the Rename for a directory's old name waits for
+// the Create of its new name before it's treated as a removal.
+const moveWait = time.Second
+
+// watched holds the inode of every source directory being watched, by
+// relative path, so a directory appearing under a new name can be
+// recognized as one that's already synced.
+var watched = struct {
+	sync.Mutex
+	dirs map[string]uint64
+}{dirs: make(map[string]uint64)}
+
+// watchDir starts watching the source directory at path, unless it and
+// everything in it is ignored.
+func watchDir(w watcher, path string, fi os.FileInfo) error {
+	rel, rerr := filepath.Rel(*fSrc, path)
+	if rerr == nil && rel != "." && ignoredDir(rel) {
+		return nil
+	}
+
+	err := w.Add(path)
+	if err != nil {
+		return err
+	}
+
+	if ino, ok := fileInode(fi); ok && rerr == nil {
+		watched.Lock()
+		watched.dirs[rel] = ino
+		watched.Unlock()
+	}
+
+	return nil
+}
+
+// unwatchDirs stops watching rel and every directory below it.
+func unwatchDirs(w watcher, rel string) {
+	watched.Lock()
+	defer watched.Unlock()
+
+	for p := range watched.dirs {
+		if p == rel || strings.HasPrefix(p, rel+string(os.PathSeparator)) {
+			w.Remove(filepath.Join(*fSrc, p))
+			delete(watched.dirs, p)
+		}
+	}
+}
+
+// unwatchAll stops watching the whole source tree.
+func unwatchAll(w watcher) {
+	watched.Lock()
+	defer watched.Unlock()
+
+	for p := range watched.dirs {
+		w.Remove(filepath.Join(*fSrc, p))
+	}
+
+	w.Remove(*fSrc)
+
+	watched.dirs = make(map[string]uint64)
+}
+
+// moves pairs the Rename event of a directory's old name with the Create
+// event of its new one, by inode.
+type moves map[uint64]string
+
+// renamed records that the directory at rel was renamed away. It returns
+// false if rel isn't a watched directory.
+func (m moves) renamed(rel string) bool {
+	watched.Lock()
+	ino, ok := watched.dirs[rel]
+	watched.Unlock()
+
+	if ok {
+		m[ino] = rel
+	}
+
+	return ok
+}
+
+// created returns the old name of the directory now at rel, if it was
+// moved there.
+func (m moves) created(rel string) (string, bool) {
+	fi, err := os.Lstat(filepath.Join(*fSrc, rel))
+	if err != nil || !fi.IsDir() {
+		return "", false
+	}
+
+	ino, ok := fileInode(fi)
+	if !ok {
+		return "", false
+	}
+
+	old, ok := m[ino]
+	if ok {
+		delete(m, ino)
+	}
+
+	return old, ok
+}
+
+// flush removes the destinations of the directories that were moved out
+// of the tree.
+func (m moves) flush(w watcher) {
+	for ino, rel := range m {
+		log.Printf("Remove %s", rel)
+
+		unwatchDirs(w, rel)
+		os.RemoveAll(destPath(rel))
+
+		publish(syncEvent{Kind: eventRemoved, Path: rel})
+		journal.done(rel)
+
+		delete(m, ino)
+	}
+}
+
+// moveOrCopy is moveDir, falling back to removing old and copying rel
+// afresh when the move fails, as when the rename crosses a mount in the
+// destination.
+func moveOrCopy(ctx context.Context, old, rel string, w watcher) {
+	err := moveDir(old, rel, w)
+	if err == nil {
+		return
+	}
+
+	opLogf(ctx, "Error moving %s to %s, copying it instead: %s", old, rel, err)
+
+	unwatchDirs(w, old)
+
+	if err = os.RemoveAll(destPath(old)); err != nil {
+		publishError(old, err)
+		recordFailure(ctx, old, err)
+	} else {
+		publish(syncEvent{Kind: eventRemoved, Path: old})
+	}
+
+	resyncTree(ctx, rel, w)
+
+	if !*fOvly {
+		if err = pruneDest(rel); err != nil {
+			publishError(rel, err)
+		}
+	}
+}
+
+// moveDir renames the destination directory for old to rel and moves the
+// watches over to the new name.
+func moveDir(old, rel string, w watcher) error {
+	err := os.Rename(destPath(old), destPath(rel))
+	if err != nil {
+		return errors.Wrapf(err, "moving %s", old)
+	}
+
+	log.Printf("Moved %s to %s", old, rel)
+
+	unwatchDirs(w, old)
+
+	return walkTree(filepath.Join(*fSrc, rel), nil, func(path, rel string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			return watchDir(w, path, fi)
+		}
+
+		return nil
+	})
+}
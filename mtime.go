@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	granularity     time.Duration
+	granularityOnce sync.Once
+)
+
+// sameMtime reports if a and b are the same modification time, give or
+// take -modify-window, for trees on hosts whose clocks disagree, and the
+// destination's timestamp granularity.
+func sameMtime(a, b time.Time) bool {
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+
+	return d <= *fMWin || d < destGranularity()
+}
+
+// destGranularity returns -mtime-granularity, or what's detected if it's
+// unset.
+func destGranularity() time.Duration {
+	granularityOnce.Do(func() {
+		granularity = *fGran
+		if granularity == 0 {
+			granularity = detectGranularity()
+		}
+	})
+
+	return granularity
+}
+
+// detectGranularity finds how finely the destination's filesystem stores
+// mtimes by setting one on a scratch file and reading it back. FAT stores
+// them to 2 seconds, and some NFS servers and older filesystems to 1.
+func detectGranularity() time.Duration {
+	dir := *fDest
+	if _, err := os.Stat(dir); err != nil {
+		dir = filepath.Dir(dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".sync-mtime")
+	if err != nil {
+		return 0
+	}
+
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// An odd second with a fraction shows both kinds of rounding.
+	probe := time.Unix(1000000001, 500000000)
+
+	if err = os.Chtimes(f.Name(), probe, probe); err != nil {
+		return 0
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return 0
+	}
+
+	var g time.Duration
+
+	switch got := fi.ModTime(); {
+	case got.Equal(probe):
+		return 0
+	case got.Unix()%2 == 0:
+		g = 2 * time.Second
+	default:
+		g = time.Second
+	}
+
+	log.Printf("Destination stores mtimes to %s, comparing them to match", g)
+
+	return g
+}
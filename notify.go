@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// notifyTimeout bounds how long sending a notice can hold things up.
+const notifyTimeout = 10 * time.Second
+
+// notifier sends a notice somewhere a person will see it.
+type notifier interface {
+	notify(msg string) error
+}
+
+var notifiers []notifier
+
+// setupNotify parses the -notify URLs and starts watching the error rate.
+func setupNotify() error {
+	if *fNtfy == "" {
+		return nil
+	}
+
+	for _, s := range notifyURLs(*fNtfy) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return errors.Wrapf(err, "parsing -notify")
+		}
+
+		switch u.Scheme {
+		case "slack":
+			notifiers = append(notifiers, &slackNotifier{
+				hook: "https://" + u.Host + u.Path,
+			})
+		case "mailto":
+			n := &mailNotifier{
+				to:   u.Opaque,
+				smtp: u.Query().Get("smtp"),
+				from: u.Query().Get("from"),
+			}
+
+			if n.smtp == "" {
+				n.smtp = "localhost:25"
+			}
+
+			if n.from == "" {
+				n.from = strings.Split(n.to, ",")[0]
+			}
+
+			notifiers = append(notifiers, n)
+		default:
+			return fmt.Errorf("unknown -notify scheme: %s", u.Scheme)
+		}
+	}
+
+	return nil
+}
+
+// notifyURLs splits the -notify list into its URLs. A mailto URL can have
+// commas between its addresses, so only a comma before a scheme starts
+// another URL.
+func notifyURLs(list string) []string {
+	var urls []string
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+
+		if n := len(urls); n > 0 && !hasScheme(s) {
+			urls[n-1] += "," + s
+			continue
+		}
+
+		urls = append(urls, s)
+	}
+
+	return urls
+}
+
+// hasScheme reports if s starts with a URL scheme.
+func hasScheme(s string) bool {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return false
+	}
+
+	for j, c := range s[:i] {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case j > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// notify sends a notice to every -notify destination, waiting for them to
+// be sent.
+func notify(format string, args ...interface{}) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	host, _ := os.Hostname()
+	msg := fmt.Sprintf("sync on %s (%s -> %s): ", host, *fSrc, *fDest) + fmt.Sprintf(format, args...)
+
+	var wg sync.WaitGroup
+
+	for _, n := range notifiers {
+		wg.Add(1)
+
+		go func(n notifier) {
+			defer wg.Done()
+
+			if err := n.notify(msg); err != nil {
+				log.Printf("Unable to send notice: %s", err)
+			}
+		}(n)
+	}
+
+	wg.Wait()
+}
+
+// errorRate counts the errors seen in the current minute, so a notice
+// goes out the first time in a minute that -notify-errors is exceeded.
+var errorRate struct {
+	sync.Mutex
+	start    time.Time
+	count    int
+	notified bool
+}
+
+func countError(ev syncEvent) {
+	errorRate.Lock()
+	defer errorRate.Unlock()
+
+	if ev.Time.Sub(errorRate.start) >= time.Minute {
+		errorRate.start = ev.Time
+		errorRate.count = 0
+		errorRate.notified = false
+	}
+
+	errorRate.count++
+
+	if errorRate.count > *fNErr && !errorRate.notified {
+		errorRate.notified = true
+
+		go notify("more than %d errors in the last minute, latest on %s: %s", *fNErr, ev.Path, ev.Error)
+	}
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	hook string
+}
+
+func (s *slackNotifier) notify(msg string) error {
+	body, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+
+	resp, err := client.Post(s.hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "posting to slack")
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("posting to slack: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// mailNotifier sends mail through an SMTP relay.
+type mailNotifier struct {
+	to, from, smtp string
+}
+
+func (m *mailNotifier) notify(msg string) error {
+	// A path with a newline in it mustn't be able to add headers.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	if len(subject) > 78 {
+		// Cut at the start of a rune, so the subject stays valid UTF-8.
+		cut := 75
+		for cut > 0 && !utf8.RuneStart(subject[cut]) {
+			cut--
+		}
+
+		subject = subject[:cut] + "..."
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.from, m.to, subject, msg)
+
+	if err := m.send([]byte(body)); err != nil {
+		return errors.Wrapf(err, "sending mail")
+	}
+
+	return nil
+}
+
+// send is smtp.SendMail without auth, giving up after notifyTimeout.
+func (m *mailNotifier) send(body []byte) error {
+	host, _, err := net.SplitHostPort(m.smtp)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", m.smtp, notifyTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(m.from); err != nil {
+		return err
+	}
+
+	for _, to := range strings.Split(m.to, ",") {
+		if err = c.Rcpt(strings.TrimSpace(to)); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Every file action gets an operation id, carried in its context, so what
+// it logs, its spans and its events can be told apart from those of
+// actions on other files running in parallel. The log lines only carry it
+// with -log-ops.
+
+var lastOp uint64
+
+type opKey struct{}
+
+// withOp returns ctx with a new operation id, unless it already has one,
+// as when a copy is part of handling an event.
+func withOp(ctx context.Context) context.Context {
+	if opOf(ctx) != 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, opKey{}, atomic.AddUint64(&lastOp, 1))
+}
+
+// opOf returns the operation id of ctx, or 0 if it has none.
+func opOf(ctx context.Context) uint64 {
+	id, _ := ctx.Value(opKey{}).(uint64)
+	return id
+}
+
+// opLogf logs like log.Printf, ending with the operation id of ctx with
+// -log-ops. It goes last so the start of the line still gives its log
+// priority.
+func opLogf(ctx context.Context, format string, v ...interface{}) {
+	if id := opOf(ctx); *fLOps && id != 0 {
+		format += fmt.Sprintf(" [op %d]", id)
+	}
+
+	log.Printf(format, v...)
+}
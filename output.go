@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// collapseWait is how long a change line is held back to see if the same
+// change repeats, so a burst of writes to one file prints once.
+const collapseWait = 250 * time.Millisecond
+
+// opTags are the tags printed for each kind of change, with their ANSI
+// color.
+var opTags = map[eventKind]struct {
+	name  string
+	color string
+}{
+	eventCopied:          {"copy", "32"},
+	eventRemoved:         {"remove", "31"},
+	eventChmodded:        {"chmod", "33"},
+	eventErrored:         {"error", "1;31"},
+	eventInitialSyncDone: {"ready", "36"},
+}
+
+// useColor reports if change lines should be colored: not with -no-color
+// or NO_COLOR set, and only when stderr is a terminal.
+func useColor() bool {
+	if *fNoCl || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startQuiet replaces the log with a line per change. The returned func
+// restores normal log output and must be called on exit.
+func startQuiet() func() {
+	events, unsubscribe := subscribe()
+
+	log.SetOutput(ioutil.Discard)
+
+	color := useColor()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		var (
+			last  syncEvent
+			count int
+			hold  = time.NewTimer(time.Hour)
+		)
+
+		hold.Stop()
+
+		flush := func() {
+			if count > 0 {
+				printChange(os.Stderr, last, count, color)
+				count = 0
+			}
+		}
+
+		defer flush()
+
+		for {
+			select {
+			case <-done:
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+
+				if count > 0 && ev.Kind == last.Kind && ev.Path == last.Path {
+					count++
+					last.Bytes = ev.Bytes
+				} else {
+					flush()
+					last, count = ev, 1
+				}
+
+				hold.Reset(collapseWait)
+			case <-hold.C:
+				flush()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+
+		unsubscribe()
+
+		log.SetOutput(logOutput)
+	}
+}
+
+// printChange writes the line for ev, which happened count times in a
+// row.
+func printChange(w io.Writer, ev syncEvent, count int, color bool) {
+	tag := opTags[ev.Kind]
+
+	name := fmt.Sprintf("%-6s", tag.name)
+	if color {
+		name = "\x1b[" + tag.color + "m" + name + "\x1b[0m"
+	}
+
+	path := ev.Path
+	if path == "" {
+		path = *fDest
+	}
+
+	line := name + " " + path
+
+	if ev.Kind == eventCopied && ev.Bytes > 0 {
+		line += fmt.Sprintf(" (%s)", humanBytes(float64(ev.Bytes)))
+	}
+
+	if ev.Error != "" {
+		line += ": " + ev.Error
+	}
+
+	if count > 1 {
+		line += fmt.Sprintf(" x%d", count)
+	}
+
+	fmt.Fprintln(w, line)
+}
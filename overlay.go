@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// With -overlay the source is an overlayfs upper directory, holding only
+// what changed from the lower layers the destination already has. Its
+// whiteouts mark paths deleted from the lower layers, and its opaque
+// directories replace the lower ones whole.
+
+// applyWhiteout removes the path the whiteout at rel deletes.
+func applyWhiteout(r syncRoots, rel string) error {
+	log.Printf("Whiteout %s", rel)
+
+	if err := os.RemoveAll(r.to(rel)); err != nil {
+		return err
+	}
+
+	publish(syncEvent{Kind: eventRemoved, Path: rel})
+
+	return nil
+}
+
+// clearOpaque removes what the lower layers put in the destination
+// directory of the opaque directory at rel.
+func clearOpaque(r syncRoots, rel string) error {
+	log.Printf("Opaque directory %s, dropping what's not in it", rel)
+
+	return pruneIn(r, rel)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isWhiteout reports if fi is an overlayfs whiteout, a character device
+// with device number 0/0.
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+
+	return ok && st.Rdev == 0
+}
+
+// isOpaque reports if the directory at path is marked opaque, by the
+// trusted xattr or, for unprivileged mounts, the user one.
+func isOpaque(path string) bool {
+	buf := make([]byte, 1)
+
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		n, err := unix.Lgetxattr(path, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// isWhiteout is always false, overlayfs is Linux only.
+func isWhiteout(fi os.FileInfo) bool {
+	return false
+}
+
+// isOpaque is always false, overlayfs is Linux only.
+func isOpaque(path string) bool {
+	return false
+}
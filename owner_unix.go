@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncOwner gives the destination entry at to the owner of the source
+// entry from, shifted by -uid-map and -gid-map. With -fake-super the owner
+// is recorded in an xattr instead, and with -restore-fake-super, ones
+// recorded in the source's xattrs are restored.
+func syncOwner(from, to string, fi os.FileInfo) error {
+	if *fFake {
+		return storeFakeSuper(to, fi)
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if *fUnfk {
+		if restored, err := restoreFakeSuper(from, to); restored || err != nil {
+			return err
+		}
+	}
+
+	return chownShifted(to, int(st.Uid), int(st.Gid))
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// syncOwner does nothing, Windows files have no uid or gid.
+func syncOwner(from, to string, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// nameMax is the longest name most filesystems allow, in bytes.
+const nameMax = 255
+
+// Source paths whose destination would be too long for the platform are
+// found before anything is written for them: with -path-limits skip they
+// are left out of the sync, like ignored paths, and reported once each;
+// with fail the sync won't start while there are any.
+
+var (
+	cwdOnce sync.Once
+	cwd     string
+
+	// tooLongSeen are the paths reported as too long.
+	tooLongSeen = struct {
+		sync.Mutex
+		m map[string]bool
+	}{m: make(map[string]bool)}
+)
+
+// pathTooLong returns why the destination of rel is too long for the
+// platform, if it is.
+func pathTooLong(rel string) string {
+	to := destPath(rel)
+
+	size := len(to)
+	if !filepath.IsAbs(to) {
+		cwdOnce.Do(func() { cwd, _ = os.Getwd() })
+		size += len(cwd) + 1
+	}
+
+	if max := pathMax(); size > max {
+		return fmt.Sprintf("its destination path is %d characters, over the limit of %d", size, max)
+	}
+
+	if name := filepath.Base(to); len(name) > nameMax {
+		return fmt.Sprintf("its name is %d bytes, over the limit of %d", len(name), nameMax)
+	}
+
+	return ""
+}
+
+// skipTooLong reports if rel is to be left out of the sync for being too
+// long, logging it the first time.
+func skipTooLong(rel string) bool {
+	if *fPLim != "skip" || rel == "." {
+		return false
+	}
+
+	why := pathTooLong(rel)
+	if why == "" {
+		return false
+	}
+
+	tooLongSeen.Lock()
+	defer tooLongSeen.Unlock()
+
+	if !tooLongSeen.m[rel] {
+		log.Printf("Skipping %s, %s", rel, why)
+		tooLongSeen.m[rel] = true
+	}
+
+	return true
+}
+
+// checkPathLimits walks the source for paths too long for the destination,
+// failing with them if there are any.
+func checkPathLimits(cancel chan os.Signal) error {
+	var bad []string
+
+	err := walkSource(cancel, func(path, rel string, fi os.FileInfo) error {
+		if why := pathTooLong(rel); why != "" {
+			bad = append(bad, fmt.Sprintf("%s: %s", rel, why))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(bad) == 0 {
+		return nil
+	}
+
+	n, more := len(bad), ""
+	if n > 10 {
+		more = fmt.Sprintf("\n  and %d more", n-10)
+		bad = bad[:10]
+	}
+
+	return errors.Errorf("%d paths are too long for the destination, see -path-limits:\n  %s%s", n, strings.Join(bad, "\n  "), more)
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "runtime"
+
+// pathMax is the longest destination path, PATH_MAX less the terminating
+// NUL.
+func pathMax() int {
+	if runtime.GOOS == "darwin" {
+		return 1023
+	}
+
+	return 4095
+}
+
+// useLongPaths does nothing, -long-paths is for Windows.
+func useLongPaths() error {
+	return nil
+}
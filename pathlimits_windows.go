@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// pathMax is the longest destination path, MAX_PATH less the terminating
+// NUL, or what \\?\ paths allow with -long-paths.
+func pathMax() int {
+	if *fLong {
+		return 32767
+	}
+
+	return 259
+}
+
+// useLongPaths makes -dest absolute for -long-paths, as Go gives absolute
+// paths past MAX_PATH the \\?\ prefix itself.
+func useLongPaths() error {
+	if !*fLong {
+		return nil
+	}
+
+	dest, err := filepath.Abs(*fDest)
+	if err != nil {
+		return err
+	}
+
+	*fDest = dest
+
+	return nil
+}
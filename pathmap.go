@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pathMap is a -map rule, putting a directory of the source somewhere
+// else in the destination.
+type pathMap struct {
+	from, to string
+
+	// flatten puts everything below from directly in to, dropping the
+	// directories in between.
+	flatten bool
+}
+
+// pathMaps is the -map flag, holding rules like "src/app/** -> app" or
+// "flatten build/assets/** -> static", given more than once or separated
+// by commas. The first rule whose directory holds a path applies to it.
+type pathMaps []pathMap
+
+var destMaps pathMaps
+
+func init() {
+	flag.Var(&destMaps, "map", "rewrite destination paths: DIR/** -> DEST puts DIR's contents in DEST, flatten DIR/** -> DEST without the directories between (repeatable)")
+}
+
+func (m *pathMaps) String() string {
+	var rules []string
+
+	for _, pm := range *m {
+		rule := filepath.ToSlash(pm.from) + "/** -> " + filepath.ToSlash(pm.to)
+		if pm.flatten {
+			rule = "flatten " + rule
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return strings.Join(rules, ",")
+}
+
+func (m *pathMaps) Set(value string) error {
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		var pm pathMap
+
+		if strings.HasPrefix(rule, "flatten ") {
+			pm.flatten = true
+			rule = strings.TrimPrefix(rule, "flatten ")
+		}
+
+		parts := strings.SplitN(rule, "->", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("expected DIR/** -> DEST, not %q", rule)
+		}
+
+		from := strings.TrimSuffix(strings.TrimSpace(parts[0]), "**")
+		if strings.ContainsAny(from, "*?[{") {
+			return errors.Errorf("only whole directories can be mapped, not %s", parts[0])
+		}
+
+		pm.from, pm.to = cleanRel(from), cleanRel(parts[1])
+		if pm.from == "" || pm.to == "" {
+			return errors.Errorf("%q must map between paths inside the trees", rule)
+		}
+
+		*m = append(*m, pm)
+	}
+
+	return nil
+}
+
+// cleanRel cleans the relative path p, returning "" if it's absolute or
+// leaves the tree.
+func cleanRel(p string) string {
+	p = filepath.Clean(filepath.FromSlash(strings.TrimSpace(p)))
+	if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(os.PathSeparator)) {
+		return ""
+	}
+
+	return p
+}
+
+// rule returns the rule applying to the source path rel, if any.
+func (m pathMaps) rule(rel string) (pathMap, bool) {
+	for _, pm := range m {
+		if within(rel, pm.from) {
+			return pm, true
+		}
+	}
+
+	return pathMap{}, false
+}
+
+// destRel returns where the source path rel goes, relative to the
+// destination.
+func destRel(rel string) string {
+	pm, ok := destMaps.rule(rel)
+
+	switch {
+	case !ok:
+		return rel
+	case rel == pm.from:
+		return pm.to
+	case pm.flatten:
+		return filepath.Join(pm.to, filepath.Base(rel))
+	default:
+		rest, _ := filepath.Rel(pm.from, rel)
+		return filepath.Join(pm.to, rest)
+	}
+}
+
+// syncRoots are the trees a walk syncs between. They're -src and -dest,
+// except for an initial sync read from a -snapshot or staged for
+// -atomic-dest.
+type syncRoots struct {
+	src, dest string
+}
+
+// liveRoots returns -src and -dest.
+func liveRoots() syncRoots {
+	return syncRoots{src: *fSrc, dest: *fDest}
+}
+
+// from returns the source path rel.
+func (r syncRoots) from(rel string) string {
+	return filepath.Join(r.src, rel)
+}
+
+// to is destPath within r.
+func (r syncRoots) to(rel string) string {
+	return filepath.Join(r.dest, destRel(rel))
+}
+
+// toDir is destDir within r.
+func (r syncRoots) toDir(rel string) string {
+	if pm, ok := destMaps.rule(rel); ok && pm.flatten {
+		return filepath.Join(r.dest, pm.to)
+	}
+
+	return r.to(rel)
+}
+
+// destPath returns where the source path rel goes in the destination.
+func destPath(rel string) string {
+	return liveRoots().to(rel)
+}
+
+// destDir is destPath for directories. Every directory below the one of a
+// flatten rule goes to its destination.
+func destDir(rel string) string {
+	return liveRoots().toDir(rel)
+}
+
+// mkdirParents makes the directories above where a mapped directory goes
+// in r, which needn't be in the source.
+func mkdirParents(r syncRoots, rel string) error {
+	if _, ok := destMaps.rule(rel); !ok {
+		return nil
+	}
+
+	return os.MkdirAll(filepath.Dir(r.toDir(rel)), 0755)
+}
+
+// mappedDest reports if the destination path rel is somewhere a rule puts
+// things, or above it. Those paths aren't in the source by the same name,
+// so they're only removed as their sources are, never pruned.
+func mappedDest(rel string) bool {
+	for _, pm := range destMaps {
+		if within(rel, pm.to) || within(pm.to, rel) {
+			return true
+		}
+	}
+
+	return false
+}
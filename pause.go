@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// While the -pause-file exists at the source root, nothing is written to
+// the destination: events are held in a batch, and retries and rescans
+// wait. Once it's removed the held batch is applied. This lets scripts
+// hold off the sync around a larger change, like a checkout, without
+// signals or sockets.
+
+// isPauseFile reports if rel is the -pause-file, which is never synced.
+func isPauseFile(rel string) bool {
+	return *fPaus != "" && filepath.Clean(rel) == filepath.Clean(*fPaus)
+}
+
+// pauseRequested reports if the -pause-file exists.
+func pauseRequested() bool {
+	if *fPaus == "" {
+		return false
+	}
+
+	_, err := os.Lstat(filepath.Join(*fSrc, *fPaus))
+
+	return err == nil
+}
+
+// waitUnpaused waits for the -pause-file to be removed, returning false if
+// cancel fires first.
+func waitUnpaused(cancel chan os.Signal) bool {
+	if !pauseRequested() {
+		return true
+	}
+
+	log.Printf("Paused until %s is removed", *fPaus)
+	state.setPhase("paused")
+
+	t := time.NewTicker(deferCheck)
+	defer t.Stop()
+
+	for pauseRequested() {
+		select {
+		case <-cancel:
+			return false
+		case <-t.C:
+		}
+	}
+
+	log.Printf("Resuming, %s was removed", *fPaus)
+
+	return true
+}
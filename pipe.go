@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// With -dest - the source is streamed to stdout as a tar, and with -src -
+// a tar read from stdin is extracted into the destination, so a sync can
+// be piped over ssh or kubectl exec, eg
+//
+//	sync -src app -dest - | ssh host sync -src - -dest /srv/app
+
+// runTarOut writes an ignore-aware tar of the source to stdout.
+func runTarOut() error {
+	cancel := make(chan os.Signal, 1)
+	notifyInterrupt(cancel)
+
+	log.Printf("Streaming %s to stdout", *fSrc)
+
+	total, err := writeSnapshot(os.Stdout, "", cancel)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Streamed %d bytes", total)
+
+	return nil
+}
+
+// runTarIn extracts the tar on stdin into the destination.
+func runTarIn() error {
+	log.Printf("Extracting stdin to %s", *fDest)
+
+	if err := os.MkdirAll(*fDest, 0755); err != nil {
+		return errors.Wrapf(err, "creating destination")
+	}
+
+	if err := extractTar(tar.NewReader(os.Stdin), *fDest, true); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(*fDest, ".synced"))
+	if err == nil {
+		f.Close()
+	}
+
+	log.Printf("Extract done")
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var priority globList
+
+func init() {
+	flag.Var(&priority, "priority", "glob of paths the initial sync copies before the rest, eg package.json or config (repeatable)")
+}
+
+// syncPriority syncs the paths matching -priority ahead of the rest of
+// the initial sync, so what the consumer needs to start is there first.
+// Matching directories are synced whole. It returns the bytes copied.
+func syncPriority(ctx context.Context, w watcher, cancel chan os.Signal, r syncRoots) (int64, error) {
+	if len(priority) == 0 {
+		return 0, nil
+	}
+
+	var first []string
+
+	err := walkFrom(r.src, r.src, cancel, func(path, rel string, fi os.FileInfo) error {
+		if rel == "." || !priority.matches(rel) {
+			return nil
+		}
+
+		first = append(first, rel)
+
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(first) == 0 {
+		return 0, nil
+	}
+
+	log.Printf("Syncing %d priority paths first", len(first))
+
+	t := &treeSync{w: w, roots: r, dirs: newDirSpans(ctx)}
+	defer t.dirs.close()
+
+	for _, rel := range first {
+		// The rest of the walk gives these their modes.
+		if err = os.MkdirAll(filepath.Dir(r.to(rel)), 0755); err != nil {
+			return t.total, err
+		}
+
+		err = walkFrom(r.src, r.from(rel), cancel, t.entry)
+		if err != nil {
+			return t.total, err
+		}
+	}
+
+	return t.total, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// destFeatures is what the destination's filesystem was found to hold.
+// Until it's probed everything is assumed to work.
+var destFeatures = struct {
+	symlinks, hardlinks, xattrs, sparse bool
+}{true, true, true, true}
+
+// sparseProbe is the size of the file with a hole used to check for
+// sparse file support.
+const sparseProbe = 1 << 20
+
+// probeDest tries out what the destination's filesystem supports on
+// scratch files, then works around or turns off what needs something it
+// lacks, saying so, rather than failing midway on the first file that
+// needs it, as on a vfat volume.
+func probeDest() error {
+	dir, err := ioutil.TempDir(probeDir(), ".sync-probe")
+	if err != nil {
+		return errors.Wrapf(err, "probing destination")
+	}
+
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "f")
+	if err = ioutil.WriteFile(f, nil, 0644); err != nil {
+		return errors.Wrapf(err, "probing destination")
+	}
+
+	destFeatures.symlinks = os.Symlink("f", filepath.Join(dir, "l")) == nil
+	destFeatures.hardlinks = os.Link(f, filepath.Join(dir, "h")) == nil
+
+	var (
+		have, lack []string
+		xok, sok   bool
+	)
+
+	destFeatures.xattrs, xok = probeXattr(f)
+	destFeatures.sparse, sok = probeSparse(filepath.Join(dir, "s"))
+
+	for _, feat := range []struct {
+		name          string
+		has, detected bool
+	}{
+		{"symlinks", destFeatures.symlinks, true},
+		{"hardlinks", destFeatures.hardlinks, true},
+		{"xattrs", destFeatures.xattrs, xok},
+		{"sparse files", destFeatures.sparse, sok},
+	} {
+		switch {
+		case !feat.detected:
+		case feat.has:
+			have = append(have, feat.name)
+		default:
+			lack = append(lack, feat.name)
+		}
+	}
+
+	log.Printf("Destination supports %s", strings.Join(have, ", "))
+
+	if len(lack) > 0 {
+		log.Printf("Destination lacks %s", strings.Join(lack, ", "))
+	}
+
+	if !destFeatures.symlinks {
+		log.Printf("Copying what symlinks point to, since the destination can't hold them")
+	}
+
+	if !destFeatures.sparse && sok {
+		log.Printf("Writing out the holes in sparse files, since the destination can't hold them")
+	}
+
+	if !destFeatures.hardlinks && *fCAS {
+		log.Printf("Turning off -cas, which needs hardlinks")
+		*fCAS = false
+	}
+
+	if !destFeatures.xattrs && *fFake {
+		log.Printf("Turning off -fake-super, which needs xattrs; owners and devices won't be kept")
+		*fFake = false
+	}
+
+	// This reports on mtimes itself.
+	destGranularity()
+
+	return nil
+}
+
+// probeDir is where the scratch files for probing go: the destination, or
+// the directory it'll be made in.
+func probeDir() string {
+	if _, err := os.Stat(*fDest); err != nil {
+		return filepath.Dir(*fDest)
+	}
+
+	return *fDest
+}
+
+// copyLinkTarget copies the file the symlink from points to to to, for
+// destinations that can't hold symlinks. Links to directories and broken
+// links are skipped.
+func copyLinkTarget(to, from string) error {
+	fi, err := os.Stat(from)
+	if err != nil {
+		log.Printf("Skipping link %s, it's broken", from)
+		return nil
+	}
+
+	if fi.IsDir() {
+		log.Printf("Skipping link %s, it points to a directory", from)
+		return nil
+	}
+
+	if tfi, err := os.Lstat(to); err == nil && tfi.Mode().IsRegular() && tfi.Size() == fi.Size() && sameMtime(tfi.ModTime(), fi.ModTime()) {
+		return nil
+	}
+
+	r, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	os.Remove(to)
+
+	w, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
+	if err != nil {
+		return errors.Wrapf(err, "opening file for writing")
+	}
+
+	_, err = copyData(limitWrite(w), limitRead(r), fi.Size())
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
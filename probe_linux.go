@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeXattr reports if user xattrs can be set on path.
+func probeXattr(path string) (bool, bool) {
+	return unix.Setxattr(path, "user.sync.probe", []byte("1"), 0) == nil, true
+}
+
+// probeSparse reports if a file at path with a hole in it takes less
+// space than its size.
+func probeSparse(path string) (bool, bool) {
+	f, err := os.Create(path)
+	if err != nil {
+		return false, false
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteAt([]byte{1}, sparseProbe-1); err != nil {
+		return false, false
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+
+	return ok && st.Blocks*512 < sparseProbe, ok
+}
+
+// holey reports if the file fi describes takes up less space than its size,
+// so has holes to keep.
+func holey(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < fi.Size()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// Only Linux needs xattrs, for -fake-super, and nothing else is checked
+// for.
+
+func probeXattr(string) (bool, bool) { return false, false }
+
+func probeSparse(string) (bool, bool) { return false, false }
+
+func holey(os.FileInfo) bool { return false }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// eventQueue buffers watcher events so receiving them never waits on
+// syncing. When it's full, like during a branch switch, the directories
+// of the events that don't fit are marked dirty to be rescanned instead.
+type eventQueue struct {
+	c chan fsnotify.Event
+
+	mu      sync.Mutex
+	dirty   map[string]bool
+	dropped int64
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{
+		c:     make(chan fsnotify.Event, size),
+		dirty: make(map[string]bool),
+	}
+}
+
+// pump moves the events of w into the queue until the returned func is
+// called.
+func (q *eventQueue) pump(w watcher) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case ev := <-w.Events():
+				if chaosDrop(ev) {
+					continue
+				}
+
+				select {
+				case q.c <- ev:
+				default:
+					q.overflow(ev)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (q *eventQueue) overflow(ev fsnotify.Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.dirty) == 0 {
+		log.Printf("Event queue full, rescanning the directories of the overflow")
+	}
+
+	q.dirty[filepath.Dir(ev.Name)] = true
+	q.dropped++
+}
+
+// markDirty has the subtree at dir rescanned.
+func (q *eventQueue) markDirty(dir string) {
+	q.mu.Lock()
+	q.dirty[dir] = true
+	q.mu.Unlock()
+}
+
+// takeDirty returns the dirty directories relative to the source, leaving
+// out any inside another one, and clears them.
+func (q *eventQueue) takeDirty() []string {
+	q.mu.Lock()
+	dirty := q.dirty
+	q.dirty = make(map[string]bool)
+	q.mu.Unlock()
+
+	var rels []string
+
+	for dir := range dirty {
+		if rel, err := filepath.Rel(*fSrc, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			rels = append(rels, rel)
+		}
+	}
+
+	sort.Strings(rels)
+
+	var top []string
+
+	for _, rel := range rels {
+		if n := len(top); n > 0 && within(rel, top[n-1]) {
+			continue
+		}
+
+		top = append(top, rel)
+	}
+
+	return top
+}
+
+// within reports if rel is dir or below it.
+func within(rel, dir string) bool {
+	return dir == "." || rel == dir || strings.HasPrefix(rel, dir+string(os.PathSeparator))
+}
+
+func (q *eventQueue) dump(w io.Writer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	fmt.Fprintf(w, "queue: %d/%d (%d overflowed, %d dirs dirty)\n", len(q.c), cap(q.c), q.dropped, len(q.dirty))
+}
+
+// rescanDirty syncs the subtrees of the dirty directories, which lost
+// their events to a full queue.
+func rescanDirty(w watcher, cancel chan os.Signal, dirs []string) (err error) {
+	ctx, span := tracer.Start(context.Background(), "sync.rescan-dirty")
+	defer func() { endSpan(span, err) }()
+
+	for _, rel := range dirs {
+		log.Printf("Rescanning %s", rel)
+
+		t := &treeSync{w: w, roots: liveRoots(), dirs: newDirSpans(ctx)}
+
+		err = walkTree(filepath.Join(*fSrc, rel), cancel, func(path, rel string, fi os.FileInfo) error {
+			if err := t.visit(path, rel, fi); err != nil {
+				publishError(rel, err)
+				recordFailure(ctx, rel, err)
+			}
+
+			return nil
+		})
+
+		t.dirs.close()
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err = pruneDest(rel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
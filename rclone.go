@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// With -dest rclone:REMOTE:PATH the tree is synced to an rclone remote,
+// so anything rclone supports can be the destination. This does the
+// watching and ignoring and hands rclone a list of files to copy per
+// batch, rather than running it per file.
+
+const rclonePrefix = "rclone:"
+
+// rcloneWait is how long changes are gathered into a batch when there's
+// no -debounce.
+const rcloneWait = time.Second
+
+// remotePath returns where rel is found on the remote.
+func remotePath(rel string) string {
+	remote := strings.TrimPrefix(*fDest, rclonePrefix)
+	if rel == "." {
+		return remote
+	}
+
+	if !strings.HasSuffix(remote, ":") && !strings.HasSuffix(remote, "/") {
+		remote += "/"
+	}
+
+	return remote + filepath.ToSlash(rel)
+}
+
+// runRclone copies the source to the remote, then keeps it in sync.
+func runRclone() error {
+	w, err := newWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	cancel := make(chan os.Signal, 1)
+	notifyInterrupt(cancel)
+
+	log.Printf("Performing initial sync to %s", remotePath("."))
+	state.setPhase("initial sync")
+
+	files, err := rcloneFiles(w, *fSrc, cancel)
+	if err != nil {
+		return err
+	}
+
+	if err = rcloneCopy(files); err != nil {
+		return err
+	}
+
+	log.Printf("Initial sync done: %d files", len(files))
+	log.Printf("Watching for events")
+	state.setPhase("watching")
+
+	wait := *fDbnc
+	if wait == 0 {
+		wait = rcloneWait
+	}
+
+	var (
+		pending = make(map[string]bool)
+		timer   = time.NewTimer(time.Hour)
+	)
+
+	timer.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			if len(pending) == 0 {
+				return nil
+			}
+
+			return rcloneApply(w, pending, cancel)
+		case err := <-w.Errors():
+			return errors.Wrapf(err, "watching")
+		case ev := <-w.Events():
+			rel, err := filepath.Rel(*fSrc, ev.Name)
+			if err != nil {
+				return err
+			}
+
+			if rel == "." || ignored(rel) || ev.Op == fsnotify.Chmod {
+				continue
+			}
+
+			pending[rel] = true
+			state.setQueued(len(pending))
+			timer.Reset(wait)
+		case <-timer.C:
+			if err = rcloneApply(w, pending, cancel); err != nil {
+				log.Printf("Unable to apply batch: %s", err)
+				publishError("", err)
+			}
+
+			pending = make(map[string]bool)
+			state.setQueued(0)
+		}
+	}
+}
+
+// rcloneApply brings the paths changed in the source in line on the
+// remote: files still there are copied in one go, the rest deleted.
+func rcloneApply(w watcher, changed map[string]bool, cancel chan os.Signal) error {
+	var files []string
+
+	for rel := range changed {
+		path := filepath.Join(*fSrc, rel)
+
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			unwatchDirs(w, rel)
+
+			if err = rcloneDelete(rel); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			// A directory moved in brings its contents with it.
+			found, err := rcloneFiles(w, path, cancel)
+			if err != nil {
+				return err
+			}
+
+			files = append(files, found...)
+		case fi.Mode().IsRegular():
+			files = append(files, rel)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	sort.Strings(files)
+
+	log.Printf("Applying batch of %d changes", len(files))
+
+	return rcloneCopy(files)
+}
+
+// rcloneFiles watches the directories below root and returns the files in
+// them that aren't ignored.
+func rcloneFiles(w watcher, root string, cancel chan os.Signal) ([]string, error) {
+	var files []string
+
+	err := walkTree(root, cancel, func(path, rel string, fi os.FileInfo) error {
+		switch {
+		case fi.IsDir():
+			return watchDir(w, path, fi)
+		case fi.Mode().IsRegular():
+			files = append(files, rel)
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// rcloneCopy has rclone copy files, relative to the source, to the remote.
+func rcloneCopy(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	list, err := ioutil.TempFile("", "sync-rclone-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(list.Name())
+
+	for _, rel := range files {
+		list.WriteString(filepath.ToSlash(rel) + "\n")
+	}
+
+	if err = list.Close(); err != nil {
+		return err
+	}
+
+	state.begin("rclone copy", "")
+	defer state.end()
+
+	if _, err = runCmd(*fRcln, "copy", "--files-from-raw", list.Name(), *fSrc, remotePath(".")); err != nil {
+		return err
+	}
+
+	for _, rel := range files {
+		publish(syncEvent{Kind: eventCopied, Path: rel})
+	}
+
+	return nil
+}
+
+// rcloneDelete removes rel from the remote, whether it was a file or a
+// directory.
+func rcloneDelete(rel string) error {
+	log.Printf("Remove %s", rel)
+
+	state.begin("rclone delete", rel)
+	defer state.end()
+
+	if _, err := runCmd(*fRcln, "deletefile", remotePath(rel)); err != nil {
+		if _, perr := runCmd(*fRcln, "purge", remotePath(rel)); perr != nil {
+			return err
+		}
+	}
+
+	publish(syncEvent{Kind: eventRemoved, Path: rel})
+
+	return nil
+}
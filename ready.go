@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// readyRecheck is how often readiness gates that haven't passed are
+// checked again.
+const readyRecheck = 5 * time.Second
+
+// readyCmdTimeout is how long a run of -ready-cmd gets before it's killed
+// and counted as failing.
+const readyCmdTimeout = time.Minute
+
+// readiness tracks the gates holding off .synced after the initial sync.
+var readiness struct {
+	checked time.Time
+	waiting string
+	ready   bool
+
+	// cmd gets the result of the run of -ready-cmd in progress, if any.
+	cmd chan error
+}
+
+// checkReady touches statusPath once the initial sync is done and every
+// readiness gate passes: with -ready-no-retries, no paths waiting to be
+// retried or deferred, and with -ready-cmd, the command exiting 0 in the
+// destination. It reports if it did.
+func checkReady(statusPath string) bool {
+	if readiness.ready {
+		return true
+	}
+
+	if time.Since(readiness.checked) < readyRecheck {
+		return false
+	}
+
+	readiness.checked = time.Now()
+
+	if why := unmetGate(); why != "" {
+		if why != readiness.waiting {
+			log.Printf("Holding off on %s: %s", statusPath, why)
+			readiness.waiting = why
+		}
+
+		return false
+	}
+
+	// Touch the status path to tell others it's ready
+	f, err := os.Create(statusPath)
+	if err == nil {
+		f.Close()
+	}
+
+	if readiness.waiting != "" {
+		log.Printf("Readiness gates passed, touched %s", statusPath)
+	}
+
+	readiness.ready = true
+
+	return true
+}
+
+// unmetGate returns why the destination isn't ready yet, or "" if it is.
+func unmetGate() string {
+	if *fRdyR {
+		failures.Lock()
+		retrying := len(failures.retrying)
+		failures.Unlock()
+
+		deferred.Lock()
+		retrying += len(deferred.paths)
+		deferred.Unlock()
+
+		if retrying > 0 {
+			return "paths are waiting to be retried"
+		}
+	}
+
+	if *fRdyC != "" {
+		return readyCmd()
+	}
+
+	return ""
+}
+
+// readyCmd returns why -ready-cmd hasn't passed yet, or "" if it has. The
+// command runs in the background, so a slow one doesn't hold up syncing;
+// until a run finishes, the last run's failure stands.
+func readyCmd() string {
+	if readiness.cmd == nil {
+		readiness.cmd = make(chan error, 1)
+
+		go func(done chan error) {
+			ctx, cancel := context.WithTimeout(context.Background(), readyCmdTimeout)
+			defer cancel()
+
+			cmd := shellCommand(ctx, *fRdyC)
+			cmd.Dir = *fDest
+
+			err := cmd.Run()
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out after %s", readyCmdTimeout)
+			}
+
+			done <- err
+		}(readiness.cmd)
+	}
+
+	select {
+	case err := <-readiness.cmd:
+		readiness.cmd = nil
+
+		if err != nil {
+			return fmt.Sprintf("%s: %s", *fRdyC, err)
+		}
+
+		return ""
+	default:
+		if readiness.waiting != "" {
+			return readiness.waiting
+		}
+
+		return fmt.Sprintf("%s hasn't finished", *fRdyC)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// With -rescan-changed, periodic rescans only read the directories whose
+// mtime changed since the last rescan. Adding, removing or renaming an
+// entry changes its directory's mtime, so an unchanged directory costs a
+// single stat: its subdirectories are known from the last rescan and
+// visited from there, and its files aren't looked at. Writes to a file in
+// place and mode changes don't show in the mtime, so they're left to
+// their events and to full rescans, and the destination is trusted to be
+// left alone between rescans.
+
+// dirPrint is what the last rescan found of a source directory.
+type dirPrint struct {
+	mtime time.Time
+	subs  []string
+}
+
+// dirPrints are the directories the last -rescan-changed rescan found in
+// sync. Full rescans, ignore reloads and a retargeted -src drop them.
+var dirPrints map[string]dirPrint
+
+// rescanDiff is the state of a -rescan-changed rescan.
+type rescanDiff struct {
+	t      *treeSync
+	cancel chan os.Signal
+	onErr  func(rel string, err error) error
+	prints map[string]dirPrint
+
+	mu  sync.Mutex
+	bad map[string]bool
+}
+
+// syncChanged is syncTree for -rescan-changed, also removing what's gone
+// from the changed directories of the destination.
+func syncChanged(ctx context.Context, w watcher, cancel chan os.Signal, onErr func(rel string, err error) error) (int64, error) {
+	d := &rescanDiff{
+		cancel: cancel,
+		onErr:  onErr,
+		prints: make(map[string]dirPrint),
+		bad:    make(map[string]bool),
+	}
+
+	// A copy failing in the pool leaves its directory to be read again
+	// next time.
+	pool := newCopyPool(liveRoots(), func(rel string, err error) error {
+		d.failed(filepath.Dir(rel))
+		return onErr(rel, err)
+	})
+
+	d.t = &treeSync{w: w, roots: liveRoots(), dirs: newDirSpans(ctx), pool: pool}
+
+	fi, err := os.Lstat(*fSrc)
+	if err == nil {
+		err = d.dir(*fSrc, ".", fi)
+	}
+
+	if pool != nil {
+		if perr := pool.wait(err != nil); err == nil {
+			err = perr
+		}
+	}
+
+	d.t.dirs.close()
+
+	if err != nil {
+		return d.t.total, err
+	}
+
+	for rel := range d.bad {
+		delete(d.prints, rel)
+	}
+
+	dirPrints = d.prints
+
+	return d.t.total, nil
+}
+
+// dir syncs the source directory rel, reading it only if it changed.
+func (d *rescanDiff) dir(path, rel string, fi os.FileInfo) error {
+	select {
+	case <-d.cancel:
+		return errors.New("canceled")
+	default:
+	}
+
+	if old, ok := dirPrints[rel]; ok && old.mtime.Equal(fi.ModTime()) {
+		d.prints[rel] = old
+
+		for _, name := range old.subs {
+			crel := filepath.Join(rel, name)
+			cpath := filepath.Join(path, name)
+
+			cfi, err := os.Lstat(cpath)
+			if err != nil || !cfi.IsDir() {
+				// Gone or replaced, which the parent's mtime would
+				// have shown; read the parent again next time.
+				d.failed(rel)
+				continue
+			}
+
+			if err := d.dir(cpath, crel, cfi); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := d.entry(path, rel, fi); err != nil {
+		return err
+	}
+
+	// The mtime from before the directory is read, so anything added
+	// while it's read shows as a change next time.
+	p := dirPrint{mtime: fi.ModTime()}
+
+	f, err := os.Open(path)
+	if err != nil {
+		d.failed(rel)
+		return d.onErr(rel, err)
+	}
+
+	defer f.Close()
+
+	for {
+		batch, rerr := f.Readdir(walkBatch)
+
+		for _, cfi := range batch {
+			crel := filepath.Join(rel, cfi.Name())
+			cpath := filepath.Join(path, cfi.Name())
+
+			if cfi.IsDir() {
+				if ignoredDir(crel) || ignored(crel) {
+					continue
+				}
+
+				p.subs = append(p.subs, cfi.Name())
+
+				if err := d.dir(cpath, crel, cfi); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if ignored(crel) {
+				continue
+			}
+
+			if err := d.entry(cpath, crel, cfi); err != nil {
+				return err
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+
+		if rerr != nil {
+			d.failed(rel)
+			return d.onErr(rel, rerr)
+		}
+	}
+
+	// An upperdir only has what changed, so the rest of the destination
+	// isn't stale.
+	if !*fOvly {
+		if err := pruneLevel(rel); err != nil {
+			d.failed(rel)
+			return d.onErr(rel, err)
+		}
+	}
+
+	d.prints[rel] = p
+
+	return nil
+}
+
+// entry syncs a single entry, passing failures to onErr.
+func (d *rescanDiff) entry(path, rel string, fi os.FileInfo) error {
+	if err := d.t.visit(path, rel, fi); err != nil {
+		d.failed(rel)
+		d.failed(filepath.Dir(rel))
+		return d.onErr(rel, err)
+	}
+
+	return nil
+}
+
+// failed keeps the directory rel from being taken as in sync.
+func (d *rescanDiff) failed(rel string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.bad[rel] = true
+}
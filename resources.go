@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+// resourceCheck is how often resource usage is checked against the soft
+// limits.
+const resourceCheck = 30 * time.Second
+
+// resourceShare is the share of a system limit warned at when no soft
+// limit is set for it.
+const resourceShare = 0.8
+
+// usage is the resources in use and what the system allows of them, where
+// known, or -1.
+type usage struct {
+	watches, files, goroutines int
+	maxWatches, maxFiles       int
+}
+
+func currentUsage() usage {
+	watched.Lock()
+	watches := len(watched.dirs)
+	watched.Unlock()
+
+	return usage{
+		watches:    watches,
+		files:      openFiles(),
+		goroutines: runtime.NumGoroutine(),
+		maxWatches: watchLimit(),
+		maxFiles:   fileLimit(),
+	}
+}
+
+// watchResources warns, and sends a -notify notice, whenever a resource
+// goes over its soft limit, so running out of watches or descriptors
+// doesn't come as a surprise.
+func watchResources() {
+	over := make(map[string]bool)
+
+	for range time.Tick(resourceCheck) {
+		u := currentUsage()
+
+		for _, r := range []struct {
+			name      string
+			used, max int
+		}{
+			{"inotify watches", u.watches, softLimit(*fWLim, u.maxWatches)},
+			{"open files", u.files, softLimit(*fFLim, u.maxFiles)},
+			{"goroutines", u.goroutines, *fGLim},
+		} {
+			switch {
+			case r.max <= 0 || r.used < 0:
+			case r.used >= r.max && !over[r.name]:
+				over[r.name] = true
+
+				msg := fmt.Sprintf("using %d %s, over the soft limit of %d", r.used, r.name, r.max)
+				log.Printf("Warning: %s", msg)
+				notify("%s", msg)
+			case r.used < r.max && over[r.name]:
+				over[r.name] = false
+				log.Printf("Back under the soft limit of %d %s", r.max, r.name)
+			}
+		}
+	}
+}
+
+// softLimit returns set, or if it's 0 a share of the system limit max.
+func softLimit(set, max int) int {
+	if set != 0 || max <= 0 {
+		return set
+	}
+
+	return int(float64(max) * resourceShare)
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// openFiles returns how many file descriptors are open, or -1.
+func openFiles() int {
+	fds, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+
+	// Reading the directory takes a descriptor of its own.
+	return len(fds) - 1
+}
+
+// fileLimit returns the soft limit on open file descriptors, or -1.
+func fileLimit() int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return -1
+	}
+
+	return int(lim.Cur)
+}
+
+// watchLimit returns the most inotify watches a user can have, or -1
+// where that isn't known, including for the backends that don't use them.
+func watchLimit() int {
+	if *fBknd != "" && *fBknd != "fsnotify" {
+		return -1
+	}
+
+	b, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return -1
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return -1
+	}
+
+	return n
+}
@@ -0,0 +1,10 @@
+package main
+
+// Windows has no descriptor or watch limits to speak of, so only
+// goroutines are checked there.
+
+func openFiles() int { return -1 }
+
+func fileLimit() int { return -1 }
+
+func watchLimit() int { return -1 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultSecrets are the files considered secret with -secrets on.
+var defaultSecrets = globList{
+	".env", ".env.*",
+	"*.pem", "*.key", "*.p12", "*.pfx",
+	"id_rsa*", "id_dsa*", "id_ecdsa*", "id_ed25519*",
+}
+
+var (
+	secretGlobs globList
+	allowGlobs  globList
+)
+
+func init() {
+	flag.Var(&secretGlobs, "secret", "additional file glob to treat as secret with -secrets (repeatable)")
+	flag.Var(&allowGlobs, "allow-secret", "file glob exempt from -secrets (repeatable)")
+}
+
+// isSecret reports if rel looks like a credential file that -secrets
+// should keep out of the destination.
+func isSecret(rel string) bool {
+	if *fSecr == "off" || *fSecr == "" {
+		return false
+	}
+
+	// Public halves of key pairs are fine to share.
+	if strings.HasSuffix(rel, ".pub") {
+		return false
+	}
+
+	if !defaultSecrets.matches(rel) && !secretGlobs.matches(rel) {
+		return false
+	}
+
+	return !allowGlobs.matches(rel)
+}
+
+var refused = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// refuseSecret reports if rel is a secret that shouldn't be copied at
+// all, logging the first refusal of each path.
+func refuseSecret(rel string) bool {
+	if *fSecr != "refuse" || !isSecret(rel) {
+		return false
+	}
+
+	refused.Lock()
+	if !refused.paths[rel] {
+		log.Printf("Refusing to copy secret %s", rel)
+		refused.paths[rel] = true
+	}
+	refused.Unlock()
+
+	return true
+}
+
+var (
+	pemKey  = regexp.MustCompile(`(?s)-----BEGIN ([A-Z0-9 ]*PRIVATE KEY)-----.*?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+	envLine = regexp.MustCompile(`(?m)^([ \t]*(?:export[ \t]+)?[A-Za-z_][A-Za-z0-9_.]*[ \t]*=[ \t]*)[^= \t\r\n].*$`)
+)
+
+// redactSecret is the transform -secrets redact applies to secret files.
+// Private key blocks and the values of KEY=VALUE lines are replaced, and
+// binary content, which can't be redacted in place, is dropped. A value
+// can't start with =, so base64 padding isn't taken for one.
+func redactSecret(rel string, b []byte) ([]byte, error) {
+	if bytes.IndexByte(b, 0) >= 0 {
+		log.Printf("Dropping content of binary secret %s", rel)
+		return nil, nil
+	}
+
+	if pemKey.Match(b) {
+		return pemKey.ReplaceAll(b, []byte("-----BEGIN $1-----\nREDACTED\n-----END $1-----")), nil
+	}
+
+	return envLine.ReplaceAll(b, []byte("${1}REDACTED")), nil
+}
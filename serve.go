@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The serve command serves the destination read-only over HTTP, with
+// directory listings, so other hosts can use the mirrored tree without
+// mounting it. Symlinks are followed only as far as they stay inside the
+// destination, since they're copied from the source as is.
+
+// runServe serves -dest on -api-addr until it fails.
+func runServe() error {
+	if *fAPI == "" {
+		return errors.New("serve requires -api-addr")
+	}
+
+	cfg, err := serverTLS()
+	if err != nil {
+		return err
+	}
+
+	var user, pass string
+
+	if *fAuth != "" {
+		i := strings.IndexByte(*fAuth, ':')
+		if i < 0 {
+			return errors.New("-serve-auth must be USER:PASSWORD")
+		}
+
+		user, pass = (*fAuth)[:i], (*fAuth)[i+1:]
+	}
+
+	files := http.FileServer(destFS{http.Dir(*fDest)})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "read only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if user != "" {
+			u, p, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(u+":"+p), []byte(user+":"+pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sync"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		rel := filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"))
+
+		// FileServer answers If-None-Match from this header.
+		if etag := fileETag(rel); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		files.ServeHTTP(w, r)
+	})
+
+	srv := &http.Server{Addr: *fAPI, Handler: handler, TLSConfig: cfg}
+
+	log.Printf("Serving %s on %s", *fDest, *fAPI)
+
+	if cfg != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	return errors.Wrapf(err, "serving %s", *fDest)
+}
+
+// destFS hides the sync's own files in the destination, from listings too.
+type destFS struct {
+	http.FileSystem
+}
+
+func (fs destFS) Open(name string) (http.File, error) {
+	rel := filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if syncInternal(rel) || !inDest(rel) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return destFile{f, rel}, nil
+}
+
+type destFile struct {
+	http.File
+	rel string
+}
+
+func (f destFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(n)
+
+	kept := fis[:0]
+	for _, fi := range fis {
+		if !syncInternal(filepath.Join(f.rel, fi.Name())) {
+			kept = append(kept, fi)
+		}
+	}
+
+	return kept, err
+}
+
+// inDest reports if rel, with any symlinks along it followed, is still
+// inside the destination.
+func inDest(rel string) bool {
+	root, err := filepath.EvalSymlinks(*fDest)
+	if err != nil {
+		return false
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Join(*fDest, rel))
+	if err != nil {
+		// Nothing there to follow, FileServer reports it missing.
+		return os.IsNotExist(err)
+	}
+
+	rel, err = filepath.Rel(root, real)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// fileETag returns the ETag for the destination file at rel. With
+// -manifest, such as the -write-manifest of the sync filling it, it's the
+// file's hash in the manifest, as long as the file hasn't changed since
+// the manifest was written. Otherwise it's the size
+// and mtime, which the sync compares files by, so they change exactly when
+// the content is synced anew.
+func fileETag(rel string) string {
+	if !inDest(rel) {
+		return ""
+	}
+
+	fi, err := os.Stat(filepath.Join(*fDest, rel))
+	if err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+
+	if sum, ok := servedManifest.sum(rel, fi); ok {
+		return `"` + sum + `"`
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// servedManifest is -manifest as last read by serve, read again when it's
+// rewritten.
+var servedManifest manifestSums
+
+type manifestSums struct {
+	sync.Mutex
+	mtime time.Time
+	sums  map[string]string
+}
+
+// sum returns the hash of rel in -manifest, if it's listed and the file,
+// stat'ed as fi, hasn't changed since the manifest was written.
+func (m *manifestSums) sum(rel string, fi os.FileInfo) (string, bool) {
+	if *fMani == "" {
+		return "", false
+	}
+
+	mfi, err := os.Stat(*fMani)
+	if err != nil || changeTime(filepath.Join(*fDest, rel), fi).After(mfi.ModTime()) {
+		return "", false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.mtime.Equal(mfi.ModTime()) {
+		sums, err := readManifestSums(*fMani)
+		if err != nil {
+			log.Printf("Unable to read -manifest for ETags: %s", err)
+			return "", false
+		}
+
+		m.sums, m.mtime = sums, mfi.ModTime()
+	}
+
+	sum, ok := m.sums[rel]
+
+	return sum, ok
+}
+
+// readManifestSums returns the hashes listed in the manifest at path, by
+// destination path.
+func readManifestSums(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(manifestHeader)) {
+		return nil, errors.New("not a sync manifest")
+	}
+
+	sums := make(map[string]string)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.SplitN(line, "  ", 2); len(fields) == 2 {
+			sums[filepath.FromSlash(fields[1])] = fields[0]
+		}
+	}
+
+	return sums, nil
+}
+
+// syncInternal reports if rel is one of the sync's own files in the
+// destination, rather than synced content.
+func syncInternal(rel string) bool {
+	if rel == ".synced" {
+		return true
+	}
+
+	if blobs, err := filepath.Rel(*fDest, blobDir()); err == nil && within(rel, blobs) {
+		return true
+	}
+
+	return strings.HasSuffix(rel, ".sync-tmp")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+// runService fails, services are a Windows thing. Use systemd or launchd
+// to run the sync unattended elsewhere.
+func runService() error {
+	return errors.New("service is only supported on Windows")
+}
+
+// asService runs cmd, there's no service manager to report to.
+func asService(cmd func() error) error {
+	return cmd()
+}
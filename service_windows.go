@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runService manages the -service-name Windows service. Its argument is
+// install, uninstall, start or stop; install registers the service to
+// run with the flags given before it, eg
+//
+//	sync service -src C:\src -dest D:\mirror -log-output file:C:\sync.log install
+func runService() error {
+	if flag.NArg() != 1 {
+		return errors.New("usage: sync service [flags] install|uninstall|start|stop")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrapf(err, "connecting to the service manager")
+	}
+
+	defer m.Disconnect()
+
+	verb := flag.Arg(0)
+
+	if verb == "install" {
+		return installService(m, os.Args[1:len(os.Args)-1])
+	}
+
+	s, err := m.OpenService(*fSvcN)
+	if err != nil {
+		return errors.Wrapf(err, "opening service %s", *fSvcN)
+	}
+
+	defer s.Close()
+
+	switch verb {
+	case "uninstall":
+		err = s.Delete()
+	case "start":
+		err = s.Start()
+	case "stop":
+		_, err = s.Control(svc.Stop)
+	default:
+		return fmt.Errorf("unknown service command: %s", verb)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "%s service %s", verb, *fSvcN)
+	}
+
+	log.Printf("Service %s: %s done", *fSvcN, verb)
+
+	return nil
+}
+
+// installService registers the service to start at boot with args,
+// restarting it if it fails.
+func installService(m *mgr.Mgr, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrapf(err, "finding executable")
+	}
+
+	if *fLogO == "stderr" {
+		log.Printf("Services have no stderr, use -log-output file:PATH to keep the log")
+	}
+
+	s, err := m.CreateService(*fSvcN, exe, mgr.Config{
+		DisplayName: "sync (" + *fSvcN + ")",
+		Description: fmt.Sprintf("Mirrors %s to %s", *fSrc, *fDest),
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return errors.Wrapf(err, "installing service %s", *fSvcN)
+	}
+
+	defer s.Close()
+
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 10 * time.Second}}
+
+	if err = s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		log.Printf("Unable to set the service to restart on failure: %s", err)
+	}
+
+	log.Printf("Installed service %s", *fSvcN)
+
+	return nil
+}
+
+// asService runs cmd, reporting to the service manager if started by it
+// and turning its stop requests into interrupts.
+func asService(cmd func() error) error {
+	ok, err := svc.IsWindowsService()
+	if err != nil || !ok {
+		return cmd()
+	}
+
+	h := &serviceHandler{cmd: cmd}
+
+	if err = svc.Run(*fSvcN, h); err != nil {
+		return errors.Wrapf(err, "running as service")
+	}
+
+	return h.err
+}
+
+type serviceHandler struct {
+	cmd func() error
+	err error
+}
+
+func (h *serviceHandler) Execute(_ []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() { done <- h.cmd() }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil {
+				log.Printf("Service failed: %s", h.err)
+				return true, 1
+			}
+
+			return false, 0
+		case r := <-reqs:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				interrupt()
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// shardedWatcher spreads directories over several fsnotify watchers, each
+// with its own kernel queue, so in a very large tree a burst in one part
+// doesn't overflow the queue for all of it. Their events are merged.
+type shardedWatcher struct {
+	shards []*fsnotify.Watcher
+	events chan fsnotify.Event
+	errors chan error
+
+	done      chan struct{}
+	forwarded sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newShardedWatcher(n int) (watcher, error) {
+	w := &shardedWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+
+	for i := 0; i < n; i++ {
+		s, err := fsnotify.NewWatcher()
+		if err != nil {
+			for _, s := range w.shards {
+				s.Close()
+			}
+
+			return nil, err
+		}
+
+		w.shards = append(w.shards, s)
+	}
+
+	for _, s := range w.shards {
+		w.forwarded.Add(1)
+		go w.forward(s)
+	}
+
+	go func() {
+		w.forwarded.Wait()
+		close(w.events)
+		close(w.errors)
+	}()
+
+	return w, nil
+}
+
+// forward passes on the events and errors of shard s until it's closed.
+func (w *shardedWatcher) forward(s *fsnotify.Watcher) {
+	defer w.forwarded.Done()
+
+	for {
+		select {
+		case ev, ok := <-s.Events:
+			if !ok {
+				return
+			}
+
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-s.Errors:
+			if !ok {
+				return
+			}
+
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// shard returns the watcher path is given to. It only depends on path, so
+// Remove finds the watcher Add used.
+func (w *shardedWatcher) shard(path string) *fsnotify.Watcher {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+
+	return w.shards[h.Sum32()%uint32(len(w.shards))]
+}
+
+func (w *shardedWatcher) Add(path string) error {
+	return w.shard(path).Add(path)
+}
+
+func (w *shardedWatcher) Remove(path string) error {
+	return w.shard(path).Remove(path)
+}
+
+func (w *shardedWatcher) Close() error {
+	var err error
+
+	w.closeOnce.Do(func() {
+		close(w.done)
+
+		for _, s := range w.shards {
+			if cerr := s.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+
+	return err
+}
+
+func (w *shardedWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *shardedWatcher) Errors() <-chan error {
+	return w.errors
+}
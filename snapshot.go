@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// runSnapshot writes an ignore-aware archive of the source to -out.
+func runSnapshot() error {
+	if *fOut == "" {
+		return errors.New("snapshot requires -out")
+	}
+
+	cancel := make(chan os.Signal, 1)
+	notifyInterrupt(cancel)
+
+	log.Printf("Writing snapshot of %s to %s", *fSrc, *fOut)
+
+	// Write to a temp name so a partial archive never sits at -out.
+	tmp := *fOut + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "creating snapshot")
+	}
+
+	total, err := writeSnapshot(f, *fOut, cancel)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, *fOut); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "renaming snapshot into place")
+	}
+
+	log.Printf("Snapshot done: %d bytes", total)
+
+	return nil
+}
+
+func writeSnapshot(w io.Writer, name string, cancel chan os.Signal) (int64, error) {
+	cw, err := compressWriter(w, name)
+	if err != nil {
+		return 0, err
+	}
+
+	tw := tar.NewWriter(cw)
+
+	total, err := writeTar(tw, *fSrc, cancel, false, nil)
+	if err != nil {
+		return total, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return total, errors.Wrapf(err, "finishing archive")
+	}
+
+	if err = cw.Close(); err != nil {
+		return total, errors.Wrapf(err, "finishing compression")
+	}
+
+	return total, nil
+}
+
+// runRestore applies the archive at -in to the destination, then
+// optionally carries on syncing from the source.
+func runRestore() error {
+	if *fIn == "" {
+		return errors.New("restore requires -in")
+	}
+
+	log.Printf("Restoring %s to %s", *fIn, *fDest)
+
+	f, err := os.Open(*fIn)
+	if err != nil {
+		return errors.Wrapf(err, "opening archive")
+	}
+
+	defer f.Close()
+
+	cr, err := compressReader(f, *fIn)
+	if err != nil {
+		return err
+	}
+
+	defer cr.Close()
+
+	if err = os.MkdirAll(*fDest, 0755); err != nil {
+		return errors.Wrapf(err, "creating destination")
+	}
+
+	if err = extractTar(tar.NewReader(cr), *fDest, true); err != nil {
+		return err
+	}
+
+	log.Printf("Restore done")
+
+	if *fWtch {
+		return run()
+	}
+
+	return nil
+}
+
+// compressWriter wraps w in the compression implied by the extension of
+// name: zstd for .zst, gzip for .gz, none otherwise.
+func compressWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// compressReader undoes the compression compressWriter applies for name.
+func compressReader(r io.Reader, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewReader(r)
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
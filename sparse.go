@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// holeBlock is the size of the runs of zeros that are left as holes.
+const holeBlock = 4096
+
+var zeroBlock = make([]byte, holeBlock)
+
+// holeWriter writes to f, seeking over whole blocks of zeros rather than
+// writing them, so a sparse source stays sparse.
+type holeWriter struct {
+	f   *os.File
+	off int64
+}
+
+// sparseWriter returns where to write a copy of the file fi to f, and a
+// func to call once it's written. The copy keeps fi's holes when it has
+// any and the destination can hold them.
+func sparseWriter(f *os.File, fi os.FileInfo) (io.Writer, func() error) {
+	if !destFeatures.sparse || !holey(fi) {
+		return f, func() error { return nil }
+	}
+
+	h := &holeWriter{f: f}
+
+	return h, h.finish
+}
+
+func (h *holeWriter) Write(b []byte) (int, error) {
+	var n int
+
+	for n < len(b) {
+		blk := b[n:]
+		if len(blk) > holeBlock {
+			blk = blk[:holeBlock]
+		}
+
+		var err error
+
+		if len(blk) == holeBlock && bytes.Equal(blk, zeroBlock) {
+			_, err = h.f.Seek(holeBlock, io.SeekCurrent)
+		} else {
+			_, err = h.f.Write(blk)
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		n += len(blk)
+		h.off += int64(len(blk))
+	}
+
+	return n, nil
+}
+
+// finish sets the size, which a hole at the end leaves short.
+func (h *holeWriter) finish() error {
+	return h.f.Truncate(h.off)
+}
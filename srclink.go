@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// srcLink is -src as given when it's a symlink, such as a current link
+// to the latest release directory. *fSrc is then the directory it points
+// to.
+var srcLink string
+
+// resolveSrc follows -src if it's a symlink.
+func resolveSrc() error {
+	fi, err := os.Lstat(*fSrc)
+	if err != nil {
+		// Left for whatever uses -src to report.
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	real, err := filepath.EvalSymlinks(*fSrc)
+	if err != nil {
+		return errors.Wrapf(err, "following %s", *fSrc)
+	}
+
+	log.Printf("Following %s to %s", *fSrc, real)
+
+	srcLink = *fSrc
+	*fSrc = real
+
+	return nil
+}
+
+// watchSrcLink returns a watcher for the directory holding the -src link,
+// to see it being repointed.
+func watchSrcLink() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = w.Add(filepath.Dir(srcLink)); err != nil {
+		w.Close()
+		return nil, errors.Wrapf(err, "watching %s", srcLink)
+	}
+
+	return w, nil
+}
+
+// isSrcLinkEvent reports if ev is for the -src link.
+func isSrcLinkEvent(ev fsnotify.Event) bool {
+	return filepath.Clean(ev.Name) == filepath.Clean(srcLink) &&
+		ev.Op&fsnotify.Create != 0
+}
+
+// followSrcLink switches to the directory the -src link points to now, if
+// it was repointed, and resyncs the destination from it in full. It
+// returns the watcher to use from then on: a fanotify watcher only takes
+// paths in the tree it was made for, so w is replaced by one for the new
+// target. w must not be pumped while this runs.
+func followSrcLink(w watcher, cancel chan os.Signal) (nw watcher, err error) {
+	real, err := filepath.EvalSymlinks(srcLink)
+	if err != nil || real == *fSrc {
+		return w, nil
+	}
+
+	log.Printf("%s now points to %s, resyncing", srcLink, real)
+	state.setPhase("resync")
+	defer state.setPhase("watching")
+
+	ctx, span := tracer.Start(context.Background(), "sync.resync")
+	defer func() { endSpan(span, err) }()
+
+	unwatchAll(w)
+	w.Close()
+
+	*fSrc = real
+	dirPrints = nil
+
+	nw, err = newWatcher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "recreating watcher")
+	}
+
+	fi, err := os.Stat(real)
+	if err != nil {
+		return nw, err
+	}
+
+	if err = watchDir(nw, real, fi); err != nil {
+		return nw, err
+	}
+
+	total, err := syncTree(ctx, nw, cancel, liveRoots(), true, func(rel string, err error) error {
+		return err
+	})
+	if err != nil {
+		return nw, err
+	}
+
+	if err = pruneDest("."); err != nil {
+		return nw, err
+	}
+
+	log.Printf("Resync done: %d bytes", total)
+
+	return nw, nil
+}
+
+// pruneDest removes everything in the destination below root that's no
+// longer in the source.
+func pruneDest(root string) error {
+	return pruneIn(liveRoots(), root)
+}
+
+// pruneIn is pruneDest within r.
+func pruneIn(r syncRoots, root string) error {
+	blobs := r.blobs()
+
+	dir := r.dest
+	if root != "." {
+		dir = r.to(root)
+	}
+
+	return streamWalk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if path == blobs {
+			return filepath.SkipDir
+		}
+
+		removed, err := pruneEntry(r, path, fi)
+		if err == nil && removed && fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return err
+	})
+}
+
+// pruneLevel is pruneDest for the entries of the destination directory
+// for root, not what's below them.
+func pruneLevel(root string) error {
+	dir := *fDest
+	if root != "." {
+		dir = destPath(root)
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer f.Close()
+
+	for {
+		batch, err := f.Readdir(walkBatch)
+
+		for _, fi := range batch {
+			if _, perr := pruneEntry(liveRoots(), filepath.Join(dir, fi.Name()), fi); perr != nil {
+				return perr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pruneEntry removes the entry at path in r's destination if it's gone
+// from the source, reporting if it did.
+func pruneEntry(r syncRoots, path string, fi os.FileInfo) (bool, error) {
+	if path == r.blobs() {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(r.dest, path)
+	if err != nil {
+		return false, err
+	}
+
+	if rel == "." || rel == ".synced" || ignored(rel) || mappedDest(rel) {
+		return false, nil
+	}
+
+	if _, err := os.Lstat(r.from(rel)); !os.IsNotExist(err) {
+		return false, nil
+	}
+
+	log.Printf("Remove %s", rel)
+
+	if err = os.RemoveAll(path); err != nil {
+		return false, err
+	}
+
+	publish(syncEvent{Kind: eventRemoved, Path: rel})
+
+	return true, nil
+}
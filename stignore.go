@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// stPattern is a line of a Syncthing .stignore file.
+type stPattern struct {
+	re *regexp.Regexp
+
+	// include is set for ! lines, which keep matching paths in the sync.
+	include bool
+
+	// deletable is set for (?d) lines, whose files may be deleted from
+	// the destination when they're in the way of removing a directory.
+	deletable bool
+
+	// dirOnly is set for gitignore lines ending in a slash, which only
+	// match directories.
+	dirOnly bool
+
+	// source is the file and line the pattern came from, for check-ignore.
+	source string
+}
+
+var stPatterns []stPattern
+
+// readStignore reads the patterns of a .stignore file, following any
+// #include lines.
+func readStignore(path string) ([]stPattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var (
+		patterns []stPattern
+		lineno   int
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "", strings.HasPrefix(line, "//"):
+			continue
+		case strings.HasPrefix(line, "#include "):
+			inc := strings.TrimSpace(strings.TrimPrefix(line, "#include "))
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(path), inc)
+			}
+
+			more, err := readStignore(inc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "including %s", inc)
+			}
+
+			patterns = append(patterns, more...)
+
+			continue
+		}
+
+		p, err := parseStPattern(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %q in %s", line, path)
+		}
+
+		p.source = fmt.Sprintf("%s:%d: %s", path, lineno, line)
+		patterns = append(patterns, p)
+	}
+
+	return patterns, scanner.Err()
+}
+
+func parseStPattern(line string) (stPattern, error) {
+	var (
+		p    stPattern
+		fold bool
+	)
+
+	for {
+		switch {
+		case strings.HasPrefix(line, "!"):
+			p.include = true
+			line = line[1:]
+		case strings.HasPrefix(line, "(?i)"):
+			fold = true
+			line = line[4:]
+		case strings.HasPrefix(line, "(?d)"):
+			p.deletable = true
+			line = line[4:]
+		default:
+			re, err := stRegexp(line, fold)
+			p.re = re
+
+			return p, err
+		}
+	}
+}
+
+// stRegexp translates a pattern to a regexp. A pattern starting with /
+// only matches from the root, others match at any depth, and a pattern
+// matching a directory matches everything in it too.
+func stRegexp(pattern string, fold bool) (*regexp.Regexp, error) {
+	var buf strings.Builder
+
+	if fold {
+		buf.WriteString("(?i)")
+	}
+
+	if strings.HasPrefix(pattern, "/") {
+		buf.WriteString("^")
+		pattern = pattern[1:]
+	} else {
+		buf.WriteString("(?:^|/)")
+	}
+
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	var inBrace bool
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			buf.WriteString("[" + class + "]")
+			i += end
+		case c == '{':
+			inBrace = true
+			buf.WriteString("(?:")
+		case c == '}' && inBrace:
+			inBrace = false
+			buf.WriteString(")")
+		case c == ',' && inBrace:
+			buf.WriteString("|")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	buf.WriteString("(?:/.*)?$")
+
+	return regexp.Compile(buf.String())
+}
+
+// stMatch returns the first pattern matching rel, if any.
+func stMatch(rel string) (stPattern, bool) {
+	rel = filepath.ToSlash(rel)
+
+	for _, p := range stPatterns {
+		if p.re.MatchString(rel) {
+			return p, true
+		}
+	}
+
+	return stPattern{}, false
+}
+
+// stIgnored reports if the .stignore patterns exclude rel.
+func stIgnored(rel string) bool {
+	p, ok := stMatch(rel)
+
+	return ok && !p.include
+}
+
+// clearDeletable removes the entries in the destination directory for rel
+// that are ignored by (?d) patterns, so the directory itself can be
+// removed.
+func clearDeletable(rel string) {
+	dir := destPath(rel)
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+
+	names, _ := f.Readdirnames(-1)
+	f.Close()
+
+	for _, name := range names {
+		child := filepath.Join(rel, name)
+
+		if p, ok := stMatch(child); ok && !p.include && p.deletable {
+			os.RemoveAll(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Copy strategies change how files matching a glob are copied:
+//
+//	append    copy only what was added since the last copy, for logs and
+//	          other files that are only written at the end
+//	skip-hot  leave the file be while it's open for writing or changing,
+//	          for databases that are only consistent at rest
+//	full      copy the whole file every time, the default, to exempt files
+//	          from a broader rule
+var strategies = map[string]bool{
+	"append":   true,
+	"skip-hot": true,
+	"full":     true,
+}
+
+type strategyRule struct {
+	glob string
+	name string
+}
+
+// strategyRules is the -strategy flag, GLOB=NAME rules separated by ; that
+// may be given more than once. The last rule matching a path decides.
+type strategyRules []strategyRule
+
+var copyStrategies strategyRules
+
+func init() {
+	flag.Var(&copyStrategies, "strategy", "copy files matching a glob by a strategy, GLOB=NAME with names append, skip-hot and full (repeatable, the last match wins)")
+}
+
+func (r *strategyRules) String() string {
+	var parts []string
+	for _, rule := range *r {
+		parts = append(parts, rule.glob+"="+rule.name)
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func (r *strategyRules) Set(value string) error {
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.LastIndex(part, "=")
+		if i <= 0 {
+			return errors.Errorf("invalid strategy %q, expected GLOB=NAME", part)
+		}
+
+		rule := strategyRule{glob: part[:i], name: part[i+1:]}
+
+		if _, err := filepath.Match(rule.glob, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", rule.glob)
+		}
+
+		if !strategies[rule.name] {
+			return errors.Errorf("unknown strategy %q", rule.name)
+		}
+
+		*r = append(*r, rule)
+	}
+
+	return nil
+}
+
+// strategyFor returns the copy strategy for rel.
+func strategyFor(rel string) string {
+	for i := len(copyStrategies) - 1; i >= 0; i-- {
+		if matchGlob(copyStrategies[i].glob, rel) {
+			return copyStrategies[i].name
+		}
+	}
+
+	return "full"
+}
+
+// appendCheck is how much of the end of the destination is compared with
+// the source before appending, to catch a file rewritten rather than
+// appended to.
+const appendCheck = 4096
+
+// appendCopy copies what the source open as ff has past the end of to,
+// returning the size to had before and the bytes appended. It returns
+// false, having done nothing, if to isn't a start of the source, so the
+// file has to be copied in full.
+func appendCopy(ff *os.File, to string, fi os.FileInfo) (int64, int64, bool, error) {
+	tfi, err := os.Lstat(to)
+	if err != nil || !tfi.Mode().IsRegular() || tfi.Size() == 0 || tfi.Size() > fi.Size() {
+		return 0, 0, false, nil
+	}
+
+	start := tfi.Size()
+
+	tf, err := os.OpenFile(to, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "opening file for appending")
+	}
+
+	defer tf.Close()
+
+	check := int64(appendCheck)
+	if check > start {
+		check = start
+	}
+
+	have, want := make([]byte, check), make([]byte, check)
+
+	if _, err = tf.ReadAt(have, start-check); err != nil {
+		return 0, 0, false, err
+	}
+
+	if _, err = ff.ReadAt(want, start-check); err != nil {
+		if err == io.EOF {
+			return 0, 0, false, nil
+		}
+
+		return 0, 0, false, err
+	}
+
+	if !bytes.Equal(have, want) {
+		return 0, 0, false, nil
+	}
+
+	if _, err = ff.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, false, err
+	}
+
+	n, err := copyData(limitWrite(chaosWriter(tf)), limitRead(ff), fi.Size()-start)
+	if err != nil {
+		return start, n, true, err
+	}
+
+	return start, n, true, tf.Close()
+}
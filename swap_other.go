@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// exchangeDirs swaps the directories at a and b. This platform has no
+// atomic exchange, so there is a brief window where b doesn't exist.
+func exchangeDirs(a, b string) error {
+	log.Printf("Atomic exchange unsupported, swapping %s and %s with renames", a, b)
+
+	tmp := b + ".old"
+
+	err := os.Rename(b, tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(a, b)
+	if err != nil {
+		os.Rename(tmp, b)
+		return err
+	}
+
+	return os.Rename(tmp, a)
+}
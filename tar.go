@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// tarSyncDirs performs the initial sync into r's empty destination by
+// streaming its source through a tar pipe, skipping the per-file stat
+// and compare the regular walk does.
+func tarSyncDirs(ctx context.Context, w watcher, cancel chan os.Signal, r syncRoots) (err error) {
+	log.Printf("Destination is empty, streaming initial sync via tar")
+
+	_, span := tracer.Start(ctx, "sync.tar")
+	defer func() { endSpan(span, err) }()
+
+	pr, pw := io.Pipe()
+
+	done := make(chan int64, 1)
+
+	go func() {
+		tw := tar.NewWriter(pw)
+
+		total, err := writeTar(tw, r.src, cancel, true, func(path string, fi os.FileInfo) {
+			watchDir(w, path, fi)
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+
+		pw.CloseWithError(err)
+		done <- total
+	}()
+
+	err = extractTar(tar.NewReader(pr), r.dest, false)
+
+	// Unblock the writer if extraction stopped early.
+	pr.CloseWithError(err)
+
+	total := <-done
+
+	span.SetAttributes(attribute.Int64("sync.bytes", total))
+
+	if err == nil {
+		err = restoreTree(r, cancel)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Initial sync done: %d bytes", total)
+
+	return nil
+}
+
+// tarUsable reports if the initial sync can go through tar. The stream
+// copies content as is, in one go, so it can't be used when any option of
+// the per-file copy is set.
+func tarUsable() bool {
+	switch {
+	case *fCAS, *fFake, !destFeatures.symlinks, len(destMaps) > 0, rewritesContent():
+		return false
+	case *fDefr, *fSetl > 0, *fVWri, *fComp, len(copyStrategies) > 0, chaosOn():
+		return false
+	case *fWork > 1, len(copyLimits) > 0:
+		return false
+	}
+
+	return true
+}
+
+// writeTar archives the source tree src into tw, returning the number of
+// content bytes written. onDir is called with the path of every directory
+// archived. Devices, pipes and sockets are skipped. With retry, files that
+// change while they're archived are synced again by the run loop;
+// without, as for snapshots, a file that shrinks fails the archive.
+func writeTar(tw *tar.Writer, src string, cancel chan os.Signal, retry bool, onDir func(path string, fi os.FileInfo)) (int64, error) {
+	var (
+		total int64
+		prog  progress
+	)
+
+	err := walkFrom(src, src, cancel, func(path, rel string, fi os.FileInfo) error {
+		state.begin("archive", rel)
+		defer state.end()
+
+		var link string
+
+		switch {
+		case fi.IsDir():
+			prog.dir(path)
+
+			if onDir != nil {
+				onDir(path, fi)
+			}
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			lnk, err := os.Readlink(path)
+			if err != nil {
+				return errors.Wrapf(err, "reading link from %s", path)
+			}
+
+			link = lnk
+		case fi.Mode().IsRegular():
+			// archived below
+		default:
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return errors.Wrapf(err, "creating header for %s", rel)
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "writing header for %s", rel)
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		n, err := io.CopyN(tw, limitRead(f), hdr.Size)
+		total += n
+
+		// The header already promised hdr.Size bytes, so a file that shrank
+		// since the stat is padded out, and copied again once it settles.
+		if err == io.EOF && retry {
+			_, err = io.CopyN(tw, zeros{}, hdr.Size-n)
+		}
+
+		if err == io.EOF {
+			return errors.Errorf("archiving %s: it shrank from %d to %d bytes while being read", rel, hdr.Size, n)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "archiving %s", rel)
+		}
+
+		if why, gone := sourceChanged(f, path, fi, n); retry && why != "" && !gone {
+			retryChanged(context.Background(), rel, why)
+		}
+
+		noteInode(rel, fi)
+
+		return nil
+	})
+
+	return total, err
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// extractTar applies the entries in tr to the directory dest. If atomic is
+// set, files are written to a temp name and renamed over the existing entry
+// so readers of dest never see a partially written file.
+func extractTar(tr *tar.Reader, dest string, atomic bool) error {
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return errors.Wrapf(err, "reading archive")
+		}
+
+		rel := filepath.Clean(filepath.FromSlash(hdr.Name))
+
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return errors.Errorf("refusing to extract %s outside of destination", hdr.Name)
+		}
+
+		if err = linkedParent(dest, rel); err != nil {
+			return err
+		}
+
+		to := filepath.Join(dest, rel)
+		mode := hdr.FileInfo().Mode()
+
+		state.begin("extract", rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(to, mode)
+		case tar.TypeReg:
+			if atomic {
+				err = extractFileAtomic(to, mode, hdr, tr)
+			} else {
+				err = extractFile(to, mode, tr)
+				if err == nil {
+					err = os.Chtimes(to, hdr.ModTime, hdr.ModTime)
+				}
+			}
+
+			if err == nil {
+				publish(syncEvent{Kind: eventCopied, Path: rel, Bytes: hdr.Size})
+			}
+		case tar.TypeSymlink:
+			os.RemoveAll(to)
+			err = os.Symlink(hdr.Linkname, to)
+		default:
+			log.Printf("Skipping unsupported archive entry %s (type %c)", hdr.Name, hdr.Typeflag)
+		}
+
+		if err == nil {
+			err = chownShifted(to, hdr.Uid, hdr.Gid)
+		}
+
+		state.end()
+
+		if err != nil {
+			return errors.Wrapf(err, "extracting %s", rel)
+		}
+	}
+}
+
+// linkedParent errors if any directory between dest and rel is a symlink,
+// so an archive can't plant a link to elsewhere and then write through it.
+func linkedParent(dest, rel string) error {
+	dir := dest
+
+	parts := strings.Split(filepath.Dir(rel), string(os.PathSeparator))
+
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return errors.Wrapf(err, "checking %s", dir)
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("refusing to extract %s through symlink %s", rel, dir)
+		}
+	}
+
+	return nil
+}
+
+func extractDir(to string, mode os.FileMode) error {
+	if fi, err := os.Lstat(to); err == nil && !fi.IsDir() {
+		if err = os.Remove(to); err != nil {
+			return errors.Wrapf(err, "removing errant non-dir")
+		}
+	}
+
+	err := os.Mkdir(to, mode)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return os.Chmod(to, mode)
+}
+
+func extractFile(to string, mode os.FileMode, r io.Reader) error {
+	if fi, err := os.Lstat(to); err == nil && !fi.Mode().IsRegular() {
+		if err = os.RemoveAll(to); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(limitWrite(f), r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(to, mode)
+}
+
+func extractFileAtomic(to string, mode os.FileMode, hdr *tar.Header, r io.Reader) error {
+	tmp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".sync-tmp")
+
+	err := extractFile(tmp, mode, r)
+	if err == nil {
+		err = os.Chtimes(tmp, hdr.ModTime, hdr.ModTime)
+	}
+
+	if err == nil {
+		if fi, lerr := os.Lstat(to); lerr == nil && fi.IsDir() {
+			err = os.RemoveAll(to)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// dirEmpty reports if dir has no entries. A missing dir is empty.
+func dirEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
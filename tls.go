@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tlsRecheck is how often the certificate files are checked for changes,
+// so rotated certificates are picked up without a restart.
+const tlsRecheck = time.Minute
+
+// certFiles holds the -tls-* files, reloading them when they change.
+type certFiles struct {
+	mu      sync.Mutex
+	checked time.Time
+	stamp   string
+
+	cert *tls.Certificate
+	cas  *x509.CertPool
+}
+
+var serverCerts certFiles
+
+// serverTLS returns the TLS config for the network servers, or nil when
+// -tls-cert isn't set. With -tls-client-ca, clients must present a
+// certificate signed by one of its CAs.
+func serverTLS() (*tls.Config, error) {
+	if *fCert == "" {
+		if *fCAs != "" {
+			return nil, fmt.Errorf("-tls-client-ca requires -tls-cert")
+		}
+
+		return nil, nil
+	}
+
+	if *fKey == "" {
+		return nil, fmt.Errorf("-tls-cert requires -tls-key")
+	}
+
+	if err := serverCerts.load(); err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := serverCerts.current()
+			return cert, nil
+		},
+	}
+
+	// Asking for a fresh config for each client picks up a rotated
+	// certificate or CA bundle.
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, cas := serverCerts.current()
+
+		cfg := &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+
+		if cas != nil {
+			cfg.ClientCAs = cas
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return cfg, nil
+	}
+
+	return base, nil
+}
+
+// current returns the certificate and client CAs, reloading them if the
+// files changed. A failed reload keeps the ones loaded before.
+func (c *certFiles) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	recheck := time.Since(c.checked) >= tlsRecheck
+	c.mu.Unlock()
+
+	if recheck {
+		if err := c.load(); err != nil {
+			log.Printf("Unable to reload TLS certificates: %s", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cert, c.cas
+}
+
+// load reads the files if their mtimes changed since they were last read.
+func (c *certFiles) load() error {
+	files := []string{*fCert, *fKey}
+	if *fCAs != "" {
+		files = append(files, *fCAs)
+	}
+
+	var stamp string
+
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+
+		stamp += fi.ModTime().String() + ";"
+	}
+
+	c.mu.Lock()
+	c.checked = time.Now()
+	same := stamp == c.stamp
+	c.mu.Unlock()
+
+	if same {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*fCert, *fKey)
+	if err != nil {
+		return errors.Wrapf(err, "loading -tls-cert")
+	}
+
+	var cas *x509.CertPool
+
+	if *fCAs != "" {
+		pem, err := ioutil.ReadFile(*fCAs)
+		if err != nil {
+			return errors.Wrapf(err, "reading -tls-client-ca")
+		}
+
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", *fCAs)
+		}
+	}
+
+	c.mu.Lock()
+	if c.stamp != "" {
+		log.Printf("Reloaded TLS certificates")
+	}
+	c.stamp = stamp
+	c.cert = &cert
+	c.cas = cas
+	c.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setupTracing installs a real provider.
+var tracer = otel.Tracer("github.com/evanphx/sync")
+
+// setupTracing configures an OTLP/HTTP exporter if an endpoint was given,
+// either via -otlp-endpoint or the standard OTEL_EXPORTER_OTLP_* env vars.
+// The returned func flushes any pending spans and must be called on exit.
+func setupTracing() (func(), error) {
+	endpoint := *fOTLP
+
+	if endpoint == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}, nil
+	}
+
+	var opts []otlptracehttp.Option
+
+	if endpoint != "" {
+		if strings.Contains(endpoint, "://") {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		} else {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+		}
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating OTLP exporter")
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("sync")))
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating trace resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer("github.com/evanphx/sync")
+
+	return func() {
+		tp.Shutdown(context.Background())
+	}, nil
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// dirSpans tracks the spans of the directories a streamWalk is
+// currently inside of, so each directory gets a span covering its
+// whole subtree.
+type dirSpans struct {
+	root  context.Context
+	paths []string
+	ctxs  []context.Context
+	spans []trace.Span
+}
+
+func newDirSpans(ctx context.Context) *dirSpans {
+	return &dirSpans{root: ctx}
+}
+
+// enter returns the context to use for path, closing the spans of any
+// directories the walk has left.
+func (d *dirSpans) enter(path string) context.Context {
+	for len(d.paths) > 0 {
+		top := d.paths[len(d.paths)-1]
+		if path == top || strings.HasPrefix(path, top+string(os.PathSeparator)) {
+			break
+		}
+
+		d.pop()
+	}
+
+	if len(d.ctxs) == 0 {
+		return d.root
+	}
+
+	return d.ctxs[len(d.ctxs)-1]
+}
+
+// push starts a span for the directory at path, a child of the current
+// directory.
+func (d *dirSpans) push(path, rel string) context.Context {
+	ctx, span := tracer.Start(d.enter(path), "sync.dir",
+		trace.WithAttributes(attribute.String("sync.path", rel)))
+
+	d.paths = append(d.paths, path)
+	d.ctxs = append(d.ctxs, ctx)
+	d.spans = append(d.spans, span)
+
+	return ctx
+}
+
+func (d *dirSpans) pop() {
+	n := len(d.paths) - 1
+	d.spans[n].End()
+
+	d.paths = d.paths[:n]
+	d.ctxs = d.ctxs[:n]
+	d.spans = d.spans[:n]
+}
+
+// close ends all the directory spans still open.
+func (d *dirSpans) close() {
+	for len(d.paths) > 0 {
+		d.pop()
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// A transform rewrites the content of a file on its way to the
+// destination. Transforms work on the whole content, so they're meant for
+// text files like configs and scripts.
+type transform func(rel string, b []byte) ([]byte, error)
+
+var transforms = map[string]transform{
+	"lf":        toLF,
+	"crlf":      toCRLF,
+	"strip-bom": stripBOM,
+	"env":       expandEnv,
+}
+
+type transformRule struct {
+	glob  string
+	names []string
+}
+
+// transformRules is the -transform flag, GLOB=NAME[,NAME] rules separated
+// by ; that may be given more than once.
+type transformRules []transformRule
+
+var rules transformRules
+
+func init() {
+	flag.Var(&rules, "transform", "transform files matching a glob on copy, GLOB=NAME[,NAME] with names lf, crlf, strip-bom and env (repeatable)")
+}
+
+func (r *transformRules) String() string {
+	var parts []string
+	for _, rule := range *r {
+		parts = append(parts, rule.glob+"="+strings.Join(rule.names, ","))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func (r *transformRules) Set(value string) error {
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.LastIndex(part, "=")
+		if i <= 0 {
+			return errors.Errorf("invalid transform %q, expected GLOB=NAME", part)
+		}
+
+		rule := transformRule{glob: part[:i]}
+
+		if _, err := filepath.Match(rule.glob, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", rule.glob)
+		}
+
+		for _, name := range strings.Split(part[i+1:], ",") {
+			if _, ok := transforms[name]; !ok {
+				return errors.Errorf("unknown transform %q", name)
+			}
+
+			rule.names = append(rule.names, name)
+		}
+
+		*r = append(*r, rule)
+	}
+
+	return nil
+}
+
+// transformsFor returns the transforms of every rule matching rel, in
+// order, followed by redaction if rel is a secret and -secrets redact is
+// on.
+func transformsFor(rel string) []transform {
+	var ts []transform
+
+	for _, rule := range rules {
+		if !matchGlob(rule.glob, rel) {
+			continue
+		}
+
+		for _, name := range rule.names {
+			ts = append(ts, transforms[name])
+		}
+	}
+
+	if *fSecr == "redact" && isSecret(rel) {
+		ts = append(ts, redactSecret)
+	}
+
+	return ts
+}
+
+// rewritesContent reports if any content may differ from the source.
+func rewritesContent() bool {
+	return len(rules) > 0 || *fSecr == "redact"
+}
+
+// transformMax is the largest file transforms are applied to, since they
+// hold the whole content in memory.
+const transformMax = 64 << 20
+
+// transformReader reads all of r and returns a reader of the content with
+// ts applied. Content over transformMax isn't copied at all rather than
+// left untransformed, which for redaction would leak it.
+func transformReader(rel string, r io.Reader, ts []transform) (io.Reader, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, transformMax+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > transformMax {
+		return nil, errors.Errorf("%s is too big to transform, the limit is %d MB", rel, transformMax>>20)
+	}
+
+	for _, t := range ts {
+		b, err = t(rel, b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "transforming %s", rel)
+		}
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// A transformed file differs in size from its source, so whether it's up
+// to date is told by the size and mtime of the source it was last made
+// from, recorded once it's copied. The copy is given the source's mtime
+// too, so a later write to it shows.
+type transformStamp struct {
+	size, mtime int64
+}
+
+var transformed = struct {
+	sync.Mutex
+	m map[string]transformStamp
+}{m: make(map[string]transformStamp)}
+
+// noteTransformed records that the transformed file at to was made from
+// the source file fi at rel.
+func noteTransformed(rel, to string, fi os.FileInfo) {
+	st := transformStamp{size: fi.Size(), mtime: fi.ModTime().UnixNano()}
+
+	transformed.Lock()
+	transformed.m[rel] = st
+	transformed.Unlock()
+
+	storeTransformed(to, st.size, st.mtime)
+}
+
+// transformedSame reports if the transformed file tfi at to was made from
+// the source file fi at rel as it is now.
+func transformedSame(rel, to string, fi, tfi os.FileInfo) bool {
+	transformed.Lock()
+	st, ok := transformed.m[rel]
+	transformed.Unlock()
+
+	if !ok {
+		st.size, st.mtime, ok = loadTransformed(to)
+	}
+
+	return ok && st.size == fi.Size() && st.mtime == fi.ModTime().UnixNano() &&
+		sameMtime(tfi.ModTime(), fi.ModTime())
+}
+
+func toLF(rel string, b []byte) ([]byte, error) {
+	return bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1), nil
+}
+
+func toCRLF(rel string, b []byte) ([]byte, error) {
+	b, _ = toLF(rel, b)
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1), nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func stripBOM(rel string, b []byte) ([]byte, error) {
+	return bytes.TrimPrefix(b, utf8BOM), nil
+}
+
+// expandEnv runs the content as a Go template with the environment as
+// its data, so {{.HOME}} becomes the value of $HOME. Unset variables
+// expand to nothing.
+func expandEnv(rel string, b []byte) ([]byte, error) {
+	tmpl, err := template.New(rel).Option("missingkey=zero").Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err = tmpl.Execute(&buf, env); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// transformAttr is the xattr recording the source a transformed file was
+// made from, so it survives restarts.
+const transformAttr = "user.sync.source"
+
+func storeTransformed(to string, size, mtime int64) {
+	if destFeatures.xattrs {
+		unix.Setxattr(to, transformAttr, []byte(fmt.Sprintf("%d %d", size, mtime)), 0)
+	}
+}
+
+func loadTransformed(to string) (size, mtime int64, ok bool) {
+	buf := make([]byte, 64)
+
+	n, err := unix.Getxattr(to, transformAttr, buf)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if _, err = fmt.Sscanf(string(buf[:n]), "%d %d", &size, &mtime); err != nil {
+		return 0, 0, false
+	}
+
+	return size, mtime, true
+}
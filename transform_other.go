@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Without Linux's user xattrs, what transformed files were made from is
+// only known for the run that made them.
+
+func storeTransformed(to string, size, mtime int64) {}
+
+func loadTransformed(to string) (size, mtime int64, ok bool) {
+	return 0, 0, false
+}
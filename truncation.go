@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// countedReader counts the bytes read through it, so what was read from a
+// source can be compared to its size even when transforms change what's
+// written.
+type countedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// sourceChanged checks the source of a finished copy, open as ff, against
+// fi, its stat from before the copy. It returns why the copy can't be
+// trusted, if it can't, and if the source is gone altogether.
+func sourceChanged(ff *os.File, from string, fi os.FileInfo, read int64) (string, bool) {
+	cur, err := ff.Stat()
+	if err != nil {
+		return "", false
+	}
+
+	if now, err := os.Stat(from); os.IsNotExist(err) {
+		return "was removed", true
+	} else if err == nil && !os.SameFile(cur, now) {
+		return "was replaced", false
+	}
+
+	if cur.Size() < fi.Size() || read < fi.Size() {
+		return fmt.Sprintf("shrank from %d to %d bytes", fi.Size(), cur.Size()), false
+	}
+
+	return "", false
+}
+
+// retryChanged puts off copying rel again until it settles, after its
+// source changed under a copy.
+func retryChanged(ctx context.Context, rel, why string) {
+	opLogf(ctx, "Source %s %s while being copied, retrying once it settles", rel, why)
+
+	if fi, err := os.Stat(filepath.Join(*fSrc, rel)); err == nil {
+		settled(rel, fi)
+	}
+
+	deferCopy(rel, "its source changed while being copied")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tuiRefresh is how often the dashboard is redrawn.
+	tuiRefresh = 500 * time.Millisecond
+
+	// tuiLines is how many recent log lines and errors are shown.
+	tuiLines = 8
+)
+
+// dashboard is the state of the -tui display, fed by the event bus and
+// the log.
+type dashboard struct {
+	mu sync.Mutex
+
+	started time.Time
+	copied  int64
+	bytes   int64
+	rate    float64
+	errors  []syncEvent
+	logs    []string
+	partial []byte
+}
+
+// Write takes log output, so log lines show up in the dashboard rather
+// than scrolling it away.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.partial = append(d.partial, p...)
+
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		d.logs = appendRecent(d.logs, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func appendRecent(lines []string, line string) []string {
+	lines = append(lines, line)
+	if len(lines) > tuiLines {
+		lines = lines[len(lines)-tuiLines:]
+	}
+
+	return lines
+}
+
+// startTUI takes over the terminal with the dashboard. The returned func
+// restores normal log output and must be called on exit.
+func startTUI() func() {
+	d := &dashboard{started: time.Now()}
+
+	events, unsubscribe := subscribe()
+
+	log.SetOutput(d)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		tick := time.NewTicker(tuiRefresh)
+		defer tick.Stop()
+
+		var (
+			last     = time.Now()
+			lastSize int64
+		)
+
+		fmt.Fprint(os.Stderr, "\x1b[2J\x1b[?25l")
+
+		for {
+			select {
+			case <-done:
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+
+				d.record(ev)
+			case now := <-tick.C:
+				d.mu.Lock()
+				d.rate = float64(d.bytes-lastSize) / now.Sub(last).Seconds()
+				lastSize = d.bytes
+				d.mu.Unlock()
+
+				last = now
+
+				d.render(os.Stderr)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+
+		unsubscribe()
+
+		d.render(os.Stderr)
+		fmt.Fprint(os.Stderr, "\x1b[?25h")
+
+		log.SetOutput(logOutput)
+	}
+}
+
+func (d *dashboard) record(ev syncEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch ev.Kind {
+	case eventCopied:
+		d.copied++
+		d.bytes += ev.Bytes
+	case eventErrored:
+		d.errors = append(d.errors, ev)
+		if len(d.errors) > tuiLines {
+			d.errors = d.errors[len(d.errors)-tuiLines:]
+		}
+	}
+}
+
+// render redraws the whole dashboard on w.
+func (d *dashboard) render(w io.Writer) {
+	var buf bytes.Buffer
+
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format, args...)
+		buf.WriteString("\x1b[K\n")
+	}
+
+	buf.WriteString("\x1b[H")
+
+	state.mu.Lock()
+	phase, op, path, since, handled, queued := state.phase, state.op, state.path, state.since, state.handled, state.queued
+	queue := state.queue
+	state.mu.Unlock()
+
+	deferred.Lock()
+	queued += len(deferred.paths)
+	deferred.Unlock()
+
+	if queue != nil {
+		queued += len(queue.c)
+	}
+
+	failures.Lock()
+	retrying, dead := len(failures.retrying), len(failures.dead)
+	failures.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	line("sync %s -> %s  (up %s)", *fSrc, *fDest, time.Since(d.started).Truncate(time.Second))
+	line("")
+	line("phase:      %s", phase)
+
+	if op != "" {
+		line("current:    %s %s (%s)", op, path, time.Since(since).Truncate(time.Millisecond))
+	} else {
+		line("current:    idle")
+	}
+
+	line("queued:     %d", queued)
+	line("handled:    %d", handled)
+	line("copied:     %d files, %d bytes", d.copied, d.bytes)
+	line("throughput: %s/s", humanBytes(d.rate))
+	line("failing:    %d retrying, %d dead letters", retrying, dead)
+	line("")
+	line("recent errors:")
+
+	for i := 0; i < tuiLines; i++ {
+		if i < len(d.errors) {
+			ev := d.errors[len(d.errors)-1-i]
+			line("  %s %s: %s", ev.Time.Format("15:04:05"), ev.Path, ev.Error)
+		} else {
+			line("")
+		}
+	}
+
+	line("log:")
+
+	for i := 0; i < tuiLines; i++ {
+		if i < len(d.logs) {
+			line("  %s", strings.TrimSpace(d.logs[i]))
+		} else {
+			line("")
+		}
+	}
+
+	buf.WriteString("\x1b[J")
+
+	w.Write(buf.Bytes())
+}
+
+// humanBytes formats n bytes with a binary unit.
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
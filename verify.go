@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// verifyDest compares the destination against the source by checksum,
+// logging every difference found. It returns an error if there were any,
+// so drift makes the process exit nonzero. With -overlay, whited out paths
+// must be gone and the rest of the destination is the lower layers', so
+// only the insides of opaque directories must match the source alone.
+func verifyDest(cancel chan os.Signal) error {
+	log.Printf("Verifying %s against %s", *fDest, *fSrc)
+	state.setPhase("verify")
+
+	var drift int
+
+	differs := func(rel, why string) {
+		log.Printf("Drift: %s %s", rel, why)
+		drift++
+	}
+
+	var (
+		seen   = make(map[string]bool)
+		opaque []string
+	)
+
+	err := walkSource(cancel, func(path, rel string, fi os.FileInfo) error {
+		to := destPath(rel)
+		if fi.IsDir() {
+			to = destDir(rel)
+		}
+
+		drel, err := filepath.Rel(*fDest, to)
+		if err != nil {
+			return err
+		}
+
+		seen[drel] = true
+
+		if rel == "." {
+			return nil
+		}
+
+		tfi, err := os.Lstat(to)
+
+		if *fOvly && isWhiteout(fi) {
+			if err == nil {
+				differs(rel, "is whited out but still there")
+			}
+
+			return nil
+		}
+
+		if *fOvly && fi.IsDir() && isOpaque(path) {
+			opaque = append(opaque, drel)
+		}
+
+		if err != nil {
+			if os.IsNotExist(err) {
+				differs(rel, "is missing")
+				return nil
+			}
+
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if !tfi.IsDir() {
+				differs(rel, "is not a directory")
+			}
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			from, _ := os.Readlink(path)
+			lnk, err := os.Readlink(to)
+			if err != nil || lnk != from {
+				differs(rel, "links elsewhere")
+			}
+		case fi.Mode().IsRegular():
+			if !tfi.Mode().IsRegular() {
+				differs(rel, "is not a regular file")
+				return nil
+			}
+
+			same, err := sameContent(rel, path, to)
+			if err != nil {
+				return err
+			}
+
+			if !same {
+				differs(rel, "has different content")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "verifying")
+	}
+
+	blobs := blobDir()
+
+	err = streamWalk(*fDest, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == blobs {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(*fDest, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == ".synced" || seen[rel] || ignored(rel) {
+			return nil
+		}
+
+		if *fOvly && !withinAny(rel, opaque) {
+			return nil
+		}
+
+		differs(rel, "is not in the source")
+
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "verifying")
+	}
+
+	if drift > 0 {
+		return fmt.Errorf("verification found %d differences", drift)
+	}
+
+	log.Printf("Verified, no differences")
+
+	return nil
+}
+
+// withinAny reports if rel is any of dirs or below one.
+func withinAny(rel string, dirs []string) bool {
+	for _, dir := range dirs {
+		if within(rel, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parallelHashMin is the size from which sameContent hashes the two
+// copies of a file concurrently.
+const parallelHashMin = 1 << 20
+
+// sameContent reports if the file at to holds what the source file at
+// from is copied as, after any transforms.
+func sameContent(rel, from, to string) (bool, error) {
+	ff, err := os.Open(from)
+	if err != nil {
+		return false, err
+	}
+
+	defer ff.Close()
+
+	var r io.Reader = ff
+
+	if ts := transformsFor(rel); ts != nil {
+		r, err = transformReader(rel, ff, ts)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	tf, err := os.Open(to)
+	if err != nil {
+		return false, err
+	}
+
+	defer tf.Close()
+
+	// Large files are read from both trees at once, rather than one after
+	// the other.
+	var (
+		got  []byte
+		gerr error
+		done = make(chan struct{})
+	)
+
+	hashDest := func() {
+		got, gerr = checksum(tf)
+		close(done)
+	}
+
+	if fi, err := tf.Stat(); err == nil && fi.Size() >= parallelHashMin {
+		go hashDest()
+	} else {
+		hashDest()
+	}
+
+	want, err := checksum(r)
+	<-done
+
+	if err != nil {
+		return false, errors.Wrapf(err, "reading %s", from)
+	}
+
+	if gerr != nil {
+		return false, errors.Wrapf(gerr, "reading %s", to)
+	}
+
+	return bytes.Equal(want, got), nil
+}
+
+func checksum(r io.Reader) ([]byte, error) {
+	h := newHash()
+
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
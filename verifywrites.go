@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// verifyAttempts is how many times -verify-writes copies a file before
+// giving up on it.
+const verifyAttempts = 3
+
+// verifiedCopy copies rel, at from, to a temp file beside to and reads it back,
+// only renaming it over to once it hashes the same as what was written.
+// If no attempt matches, to is left holding its previous version.
+func verifiedCopy(ctx context.Context, rel, from, to string, fi os.FileInfo) (int64, error) {
+	tmp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".sync-tmp")
+
+	var err error
+
+	for i := 1; i <= verifyAttempts; i++ {
+		var (
+			n    int64
+			want []byte
+		)
+
+		n, want, err = copyHashed(rel, from, tmp, fi)
+		if err == nil {
+			var got []byte
+
+			got, err = fileChecksum(tmp)
+			if err == nil && bytes.Equal(got, want) {
+				return n, errors.Wrapf(os.Rename(tmp, to), "replacing %s", rel)
+			}
+
+			if err == nil {
+				err = fmt.Errorf("%s doesn't read back as written", rel)
+			}
+		}
+
+		opLogf(ctx, "Write of %s failed verification (attempt %d of %d): %s", rel, i, verifyAttempts, err)
+	}
+
+	os.Remove(tmp)
+
+	return 0, errors.Wrapf(err, "keeping the previous version of %s", rel)
+}
+
+// copyHashed copies rel, at from, to tmp, returning the number of bytes and the
+// hash of what was written. tmp is synced and, on Linux, dropped from the
+// page cache, so reading it back checks the disk rather than the copy
+// still in memory.
+func copyHashed(rel, from, tmp string, fi os.FileInfo) (int64, []byte, error) {
+	ff, err := os.Open(from)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer ff.Close()
+
+	src := &countedReader{r: ff}
+
+	var r io.Reader = limitRead(src)
+
+	if ts := transformsFor(rel); ts != nil {
+		r, err = transformReader(rel, r, ts)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Start from a fresh file so it gets the mode even after a failed attempt.
+	os.Remove(tmp)
+
+	tf, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "opening file for writing")
+	}
+
+	h := newHash()
+
+	n, err := copyData(io.MultiWriter(limitWrite(chaosWriter(tf)), h), r, fi.Size())
+	if err == nil {
+		err = tf.Sync()
+	}
+
+	if err == nil {
+		err = dropCache(tf)
+	}
+
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+
+	if why, _ := sourceChanged(ff, from, fi, src.n); err == nil && why != "" {
+		err = errors.Errorf("source %s while being copied", why)
+	}
+
+	return n, h.Sum(nil), err
+}
@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCache evicts the synced pages of f from the page cache, so reading
+// it back comes from the disk.
+func dropCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
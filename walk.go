@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// walkBatch is how many entries streamWalk reads from a directory at once.
+const walkBatch = 1024
+
+// streamWalk is filepath.Walk, except that it reads directories in batches
+// as it goes instead of listing and sorting each one whole, so a directory
+// with hundreds of thousands of entries doesn't need them all in memory.
+// Entries are visited in directory order.
+func streamWalk(root string, fn filepath.WalkFunc) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkEntry(root, fi, fn)
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func walkEntry(path string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, fi, nil); err != nil || !fi.IsDir() {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fn(path, fi, err)
+	}
+
+	defer f.Close()
+
+	for {
+		batch, err := f.Readdir(walkBatch)
+
+		for _, cfi := range batch {
+			// As with filepath.Walk, SkipDir from a file skips the rest of
+			// its directory.
+			werr := walkEntry(filepath.Join(path, cfi.Name()), cfi, fn)
+			if werr != nil && (!cfi.IsDir() || werr != filepath.SkipDir) {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fn(path, fi, err)
+		}
+	}
+}
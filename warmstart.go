@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A destination filled by another tool, like cp without -p, has the
+// source's content but not its mtimes, so every file would be copied
+// again. With -warm-start, the first run hashes the files that match in
+// size but not mtime instead, and gives those with the same content the
+// source's mtime rather than copying them, so from then on they compare
+// as unchanged like any other. The matches are also recorded in the
+// fingerprint file, one per line as "HASH  SIZE MTIME PATH", so ones whose
+// mtime couldn't be set aren't hashed again while the source's size and
+// mtime match what was recorded.
+
+type warmPrint struct {
+	size  int64
+	mtime int64
+	sum   []byte
+}
+
+var fingerprints = struct {
+	sync.Mutex
+	m     map[string]warmPrint
+	first bool
+	added int
+}{m: make(map[string]warmPrint)}
+
+// loadFingerprints reads the -warm-start file. Without one, this is the
+// first run, which makes it.
+func loadFingerprints() error {
+	f, err := os.Open(*fWarm)
+	if os.IsNotExist(err) {
+		log.Printf("No fingerprints in %s yet, comparing the destination's files by content", *fWarm)
+		fingerprints.first = true
+
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "opening fingerprints")
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var fp warmPrint
+
+		fields := strings.SplitN(scanner.Text(), " ", 5)
+		if len(fields) != 5 || fields[1] != "" {
+			return errors.Errorf("%s:%d: malformed fingerprint", *fWarm, n)
+		}
+
+		if fp.sum, err = hex.DecodeString(fields[0]); err == nil {
+			if fp.size, err = strconv.ParseInt(fields[2], 10, 64); err == nil {
+				fp.mtime, err = strconv.ParseInt(fields[3], 10, 64)
+			}
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d: malformed fingerprint", *fWarm, n)
+		}
+
+		fingerprints.m[filepath.FromSlash(fields[4])] = fp
+	}
+
+	return scanner.Err()
+}
+
+// warmMatch reports if the destination file tfi at to has the content of
+// the source file fi at rel, found at from, though their mtimes differ, going by the
+// fingerprints or, on the first run, by hashing both. A match is given the
+// source's mtime.
+func warmMatch(rel, from, to string, fi, tfi os.FileInfo) bool {
+	if *fWarm == "" || tfi.Size() != fi.Size() {
+		return false
+	}
+
+	fingerprints.Lock()
+	fp, ok := fingerprints.m[rel]
+	first := fingerprints.first
+	fingerprints.Unlock()
+
+	if ok {
+		if fp.size != fi.Size() || fp.mtime != fi.ModTime().UnixNano() {
+			return false
+		}
+
+		warmTimes(to, fi)
+
+		return true
+	}
+
+	if !first {
+		return false
+	}
+
+	sum, err := fileChecksum(from)
+	if err != nil {
+		return false
+	}
+
+	dsum, err := fileChecksum(to)
+	if err != nil || !bytes.Equal(sum, dsum) {
+		return false
+	}
+
+	fingerprints.Lock()
+	fingerprints.m[rel] = warmPrint{size: fi.Size(), mtime: fi.ModTime().UnixNano(), sum: sum}
+	fingerprints.added++
+	fingerprints.Unlock()
+
+	warmTimes(to, fi)
+
+	return true
+}
+
+// warmTimes gives the destination file at to, which matched by content,
+// the mtime of the source file fi.
+func warmTimes(to string, fi os.FileInfo) {
+	if err := os.Chtimes(to, fi.ModTime(), fi.ModTime()); err != nil {
+		log.Printf("Unable to set the mtime of %s, which matched by content: %s", to, err)
+	}
+}
+
+// saveFingerprints writes the fingerprints found this run, if any, to the
+// -warm-start file.
+func saveFingerprints() error {
+	fingerprints.Lock()
+	defer fingerprints.Unlock()
+
+	if fingerprints.added == 0 {
+		return nil
+	}
+
+	rels := make([]string, 0, len(fingerprints.m))
+	for rel := range fingerprints.m {
+		rels = append(rels, rel)
+	}
+
+	sort.Strings(rels)
+
+	var buf bytes.Buffer
+
+	for _, rel := range rels {
+		fp := fingerprints.m[rel]
+		fmt.Fprintf(&buf, "%x  %d %d %s\n", fp.sum, fp.size, fp.mtime, filepath.ToSlash(rel))
+	}
+
+	tmp := *fWarm + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "writing fingerprints")
+	}
+
+	if err := os.Rename(tmp, *fWarm); err != nil {
+		return errors.Wrapf(err, "writing fingerprints")
+	}
+
+	log.Printf("Recorded %d files matching by content in %s", fingerprints.added, *fWarm)
+
+	fingerprints.added = 0
+	fingerprints.first = false
+
+	return nil
+}
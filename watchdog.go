@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// restartLimit is how many times the watcher is recreated within
+	// restartWindow before the failures are taken to be permanent.
+	restartLimit  = 5
+	restartWindow = 10 * time.Minute
+)
+
+// watchdog recreates the watcher when it fails.
+type watchdog struct {
+	restarts []time.Time
+}
+
+// restart replaces w, which failed with cause, with a new watcher on the
+// whole source tree, and rescans so no change missed in between is lost.
+// It gives up with an error when the watcher keeps failing.
+func (d *watchdog) restart(w watcher, cause error, cancel chan os.Signal) (watcher, error) {
+	now := time.Now()
+
+	recent := d.restarts[:0]
+	for _, t := range d.restarts {
+		if now.Sub(t) < restartWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	d.restarts = append(recent, now)
+
+	if len(d.restarts) > restartLimit {
+		return nil, errors.Wrapf(cause, "watcher failed %d times in %s", len(d.restarts), restartWindow)
+	}
+
+	log.Printf("Watcher failed, restarting it: %s", cause)
+
+	unwatchAll(w)
+	w.Close()
+
+	nw, err := newWatcher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "recreating watcher")
+	}
+
+	fi, err := os.Stat(*fSrc)
+	if err == nil {
+		err = watchDir(nw, *fSrc, fi)
+	}
+
+	if err == nil {
+		err = rescan(nw, cancel, false)
+	}
+
+	if err != nil {
+		nw.Close()
+		return nil, err
+	}
+
+	return nw, nil
+}
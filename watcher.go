@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// watcher is a source of filesystem events. Every backend reports changes
+// as fsnotify events so they all feed the same pipeline. Backends that
+// watch recursively treat Add and Remove of paths below a watched
+// directory as no-ops.
+type watcher interface {
+	Add(path string) error
+	Remove(path string) error
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// newWatcher creates the backend selected by -watcher.
+func newWatcher() (watcher, error) {
+	backend := *fBknd
+	if backend == "" {
+		backend = defaultBackend
+	}
+
+	switch backend {
+	case "fsnotify":
+		if *fShrd > 1 {
+			return newShardedWatcher(*fShrd)
+		}
+
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+
+		return fsnotifyWatcher{w}, nil
+	case "fanotify":
+		return newFanotifyWatcher()
+	case "windows":
+		return newWindowsWatcher()
+	default:
+		return nil, errors.Errorf("unknown watcher backend: %s", backend)
+	}
+}
+
+// fsnotifyWatcher watches each directory individually via fsnotify.
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event {
+	return w.Watcher.Events
+}
+
+func (w fsnotifyWatcher) Errors() <-chan error {
+	return w.Watcher.Errors
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+const defaultBackend = "fsnotify"
+
+func newWindowsWatcher() (watcher, error) {
+	return nil, errors.New("the windows watcher is only available on Windows")
+}
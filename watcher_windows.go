@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// On Windows a single ReadDirectoryChangesW call watches a whole tree, so
+// large trees don't need a handle per directory.
+const defaultBackend = "windows"
+
+const windowsNotifyFilter = windows.FILE_NOTIFY_CHANGE_FILE_NAME |
+	windows.FILE_NOTIFY_CHANGE_DIR_NAME |
+	windows.FILE_NOTIFY_CHANGE_ATTRIBUTES |
+	windows.FILE_NOTIFY_CHANGE_SIZE |
+	windows.FILE_NOTIFY_CHANGE_LAST_WRITE
+
+// windowsWatcher watches a directory tree recursively with
+// ReadDirectoryChangesW.
+type windowsWatcher struct {
+	mu   sync.Mutex
+	root string
+	h    windows.Handle
+	ov   windows.Overlapped
+
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+}
+
+func newWindowsWatcher() (watcher, error) {
+	return &windowsWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (w *windowsWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *windowsWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Add starts watching the tree at path. Paths inside an already watched
+// tree are covered and ignored.
+func (w *windowsWatcher) Add(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.root != "" {
+		if path == w.root || strings.HasPrefix(path, w.root+string(os.PathSeparator)) {
+			return nil
+		}
+
+		return errors.Errorf("%s is outside the watched tree %s", path, w.root)
+	}
+
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	h, err := windows.CreateFile(p,
+		windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED,
+		0)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", path)
+	}
+
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(h)
+		return err
+	}
+
+	w.root = path
+	w.h = h
+	w.ov.HEvent = ev
+
+	go w.loop()
+
+	return nil
+}
+
+// Remove is a no-op, a removed directory simply stops producing events.
+func (w *windowsWatcher) Remove(path string) error {
+	return nil
+}
+
+func (w *windowsWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+
+	close(w.done)
+
+	if w.root == "" {
+		return nil
+	}
+
+	windows.CancelIoEx(w.h, &w.ov)
+
+	return nil
+}
+
+func (w *windowsWatcher) loop() {
+	defer windows.CloseHandle(w.ov.HEvent)
+	defer windows.CloseHandle(w.h)
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		var n uint32
+
+		err := windows.ReadDirectoryChanges(w.h, &buf[0], uint32(len(buf)), true,
+			windowsNotifyFilter, nil, &w.ov, 0)
+		if err == nil {
+			err = windows.GetOverlappedResult(w.h, &w.ov, &n, true)
+		}
+
+		if err != nil {
+			if err == windows.ERROR_OPERATION_ABORTED {
+				return
+			}
+
+			w.sendError(errors.Wrapf(err, "reading changes"))
+			return
+		}
+
+		// A zero length read means the kernel buffer overflowed and
+		// changes were lost.
+		if n == 0 {
+			if !w.sendError(fsnotify.ErrEventOverflow) {
+				return
+			}
+
+			continue
+		}
+
+		if !w.parse(buf[:n]) {
+			return
+		}
+	}
+}
+
+// parse sends the events in buf, a series of FILE_NOTIFY_INFORMATION
+// records. It returns false if the watcher was closed.
+func (w *windowsWatcher) parse(buf []byte) bool {
+	var offset uint32
+
+	for {
+		info := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+
+		name := windows.UTF16ToString(unsafe.Slice(&info.FileName, info.FileNameLength/2))
+
+		ev := fsnotify.Event{Name: filepath.Join(w.root, name)}
+
+		switch info.Action {
+		case windows.FILE_ACTION_ADDED, windows.FILE_ACTION_RENAMED_NEW_NAME:
+			ev.Op = fsnotify.Create
+		case windows.FILE_ACTION_REMOVED:
+			ev.Op = fsnotify.Remove
+		case windows.FILE_ACTION_RENAMED_OLD_NAME:
+			ev.Op = fsnotify.Rename
+		case windows.FILE_ACTION_MODIFIED:
+			ev.Op = fsnotify.Write
+		}
+
+		if ev.Op != 0 {
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return false
+			}
+		}
+
+		if info.NextEntryOffset == 0 {
+			return true
+		}
+
+		offset += info.NextEntryOffset
+	}
+}
+
+func (w *windowsWatcher) sendError(err error) bool {
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
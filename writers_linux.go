@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writerScanTTL is how long a scan of open files is reused, so checking
+// every file of a large sync doesn't rescan /proc each time.
+const writerScanTTL = time.Second
+
+var writers struct {
+	sync.Mutex
+	at    time.Time
+	paths map[string]bool
+}
+
+// openForWriting reports if another process has the source file at rel
+// open for writing.
+func openForWriting(rel string) bool {
+	writers.Lock()
+	defer writers.Unlock()
+
+	if writers.paths == nil || time.Since(writers.at) > writerScanTTL {
+		writers.paths = scanWriters()
+		writers.at = time.Now()
+	}
+
+	return writers.paths[rel]
+}
+
+// scanWriters walks the fds of every process in /proc, returning the
+// source relative paths of the files open for writing.
+func scanWriters() map[string]bool {
+	paths := make(map[string]bool)
+
+	src, err := filepath.Abs(*fSrc)
+	if err != nil {
+		return paths
+	}
+
+	if s, err := filepath.EvalSymlinks(src); err == nil {
+		src = s
+	}
+
+	prefix := src + string(os.PathSeparator)
+
+	pids, err := readNames("/proc")
+	if err != nil {
+		return paths
+	}
+
+	self := strconv.Itoa(os.Getpid())
+
+	for _, pid := range pids {
+		if pid == self || pid[0] < '0' || pid[0] > '9' {
+			continue
+		}
+
+		dir := filepath.Join("/proc", pid)
+
+		// Processes of other users can't be inspected without
+		// privileges and are skipped.
+		fds, err := readNames(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(dir, "fd", fd))
+			if err != nil || !strings.HasPrefix(target, prefix) {
+				continue
+			}
+
+			if fdWritable(filepath.Join(dir, "fdinfo", fd)) {
+				paths[target[len(prefix):]] = true
+			}
+		}
+	}
+
+	return paths
+}
+
+// fdWritable reads the open flags from an fdinfo file.
+func fdWritable(info string) bool {
+	f, err := os.Open(info)
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+
+		flags, err := strconv.ParseInt(strings.TrimSpace(line[len("flags:"):]), 8, 64)
+		if err != nil {
+			return false
+		}
+
+		acc := flags & int64(os.O_WRONLY|os.O_RDWR)
+
+		return acc == int64(os.O_WRONLY) || acc == int64(os.O_RDWR)
+	}
+
+	return false
+}
+
+func readNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// openForWriting always reports false, active writers can only be
+// detected via /proc on Linux.
+func openForWriting(rel string) bool {
+	return false
+}